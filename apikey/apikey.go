@@ -0,0 +1,137 @@
+// Command apikey manages the API keys stored in the database, for setting
+// up a deployment before any admin key exists.
+//
+//	go run ./apikey create -name ops -scopes admin
+//	go run ./apikey create -name shop -merchant <id> -scopes invoices:create,invoices:read -expires 2026-12-31 -rate 30 -burst 10
+//	go run ./apikey list
+//	go run ./apikey rotate <id>
+//	go run ./apikey revoke <id>
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"qpay/config"
+	"qpay/models"
+
+	"github.com/google/uuid"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	config.LoadConfig()
+	config.ConnectDatabase()
+	ctx := context.Background()
+
+	switch os.Args[1] {
+	case "create":
+		create(ctx, os.Args[2:])
+	case "list":
+		list(ctx)
+	case "rotate":
+		apiKey := models.APIKey{ID: parseID(os.Args[2:])}
+		key, err := apiKey.Rotate(ctx)
+		if err != nil {
+			log.Fatal("❌ Could not rotate API key: ", err)
+		}
+		printKey(&apiKey, key)
+	case "revoke":
+		apiKey := models.APIKey{ID: parseID(os.Args[2:])}
+		if err := apiKey.Revoke(ctx); err != nil {
+			log.Fatal("❌ Could not revoke API key: ", err)
+		}
+		fmt.Printf("✅ API key %v (%v) revoked\n", apiKey.ID, apiKey.Prefix)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apikey create -name NAME -scopes SCOPE,... [-merchant ID] [-expires 2006-01-02] [-rate N -burst N]")
+	fmt.Fprintln(os.Stderr, "       apikey list | rotate ID | revoke ID")
+	os.Exit(2)
+}
+
+func create(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	name := fs.String("name", "", "name of the key")
+	merchant := fs.String("merchant", "", "merchant ID, the default merchant if empty")
+	scopes := fs.String("scopes", "", "comma separated scopes")
+	expires := fs.String("expires", "", "expiry date, 2006-01-02")
+	rate := fs.Int("rate", 0, "requests per minute, the default rate limit if 0")
+	burst := fs.Int("burst", 0, "burst of the rate limit, required with -rate")
+	fs.Parse(args)
+
+	if *name == "" {
+		log.Fatal("❌ -name is required")
+	}
+	if *rate < 0 || *burst < 0 || (*rate == 0) != (*burst == 0) {
+		log.Fatal("❌ -rate and -burst must be positive and given together")
+	}
+	apiKey := models.APIKey{Name: *name, RatePerMinute: *rate, RateBurst: *burst}
+
+	var err error
+	if apiKey.Scopes, err = models.ParseScopes(strings.Split(*scopes, ",")); err != nil {
+		log.Fatal("❌ ", err)
+	}
+	if *merchant != "" {
+		if apiKey.MerchantID, err = uuid.Parse(*merchant); err != nil {
+			log.Fatal("❌ Invalid merchant ID: ", err)
+		}
+	}
+	m := models.Merchant{ID: apiKey.MerchantID}
+	if err = m.Read(ctx); err != nil {
+		log.Fatal("❌ Could not read merchant: ", err)
+	}
+	if *expires != "" {
+		t, err := time.Parse("2006-01-02", *expires)
+		if err != nil {
+			log.Fatal("❌ -expires must be formatted as 2006-01-02")
+		}
+		apiKey.ExpiresAt = &t
+	}
+
+	key, err := apiKey.Create(ctx)
+	if err != nil {
+		log.Fatal("❌ Could not create API key: ", err)
+	}
+	printKey(&apiKey, key)
+}
+
+func list(ctx context.Context) {
+	keys, err := models.ListAPIKeys(ctx, nil)
+	if err != nil {
+		log.Fatal("❌ Could not list API keys: ", err)
+	}
+	for _, k := range keys {
+		state := "active"
+		if !k.Active() {
+			state = "inactive"
+		}
+		fmt.Printf("%v  %-10v  %-8v  %-20v  merchant %v  %v\n", k.ID, k.Prefix, state, k.Name, k.MerchantID, k.Scopes)
+	}
+}
+
+func parseID(args []string) uuid.UUID {
+	if len(args) != 1 {
+		usage()
+	}
+	id, err := uuid.Parse(args[0])
+	if err != nil {
+		log.Fatal("❌ Invalid API key ID: ", err)
+	}
+	return id
+}
+
+func printKey(apiKey *models.APIKey, key string) {
+	fmt.Printf("✅ API key %v (%v), shown only once:\n%v\n", apiKey.ID, apiKey.Name, key)
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -30,6 +31,55 @@ type Config struct {
 		InvoiceCode   string
 		URL           string
 		ExpireSeconds int
+		MaxAmount     int
+		MerchantID    string
+	}
+
+	Webhook struct {
+		Enabled         bool
+		Secret          string
+		MaxAttempts     int
+		IntervalSeconds int
+	}
+
+	Poller struct {
+		IntervalSeconds    int
+		Concurrency        int
+		BatchSize          int
+		BaseBackoffSeconds int
+		MaxBackoffSeconds  int
+		ExpirySweepSeconds int
+	}
+
+	Ebarimt struct {
+		Auto            bool
+		DistrictCode    string
+		MaxAttempts     int
+		IntervalSeconds int
+	}
+
+	Reconcile struct {
+		AutoFix bool
+		Hour    int
+	}
+
+	Reports struct {
+		SettlementEmails []string
+		SettlementHour   int
+		SettlementDays   int
+	}
+
+	QR struct {
+		LogoPath string
+	}
+
+	RateLimit struct {
+		Store       string
+		PerMinute   int
+		Burst       int
+		IPPerMinute int
+		IPBurst     int
+		Routes      []string
 	}
 
 	App struct {
@@ -66,13 +116,60 @@ func LoadConfig() *Config {
 	config.QPay.InvoiceCode = getEnv("QPAY_INVOICE_CODE", "INV-000")
 	config.QPay.URL = getEnv("QPAY_URL", "https://merchant.qpay.mn/v2")
 	config.QPay.ExpireSeconds = getEnvAsInt("QPAY_INVOICE_EXPIRE_SECONDS", 600)
+	config.QPay.MaxAmount = getEnvAsInt("QPAY_INVOICE_MAX_AMOUNT", 100000000)
+	config.QPay.MerchantID = getEnv("QPAY_MERCHANT_ID", "")
+
+	// Webhook Config
+	config.Webhook.Enabled = getEnv("WEBHOOK_ENABLED", "false") == "true"
+	config.Webhook.Secret = getEnv("WEBHOOK_SECRET", "")
+	if config.Webhook.Enabled && config.Webhook.Secret == "" {
+		// deliveries are never signed with an empty key, those of the
+		// default merchant fail until the secret is set
+		log.Warn().Msg("⚠️  WEBHOOK_SECRET is not set, webhooks of the default merchant will not be delivered")
+	}
+	config.Webhook.MaxAttempts = getEnvAsPositiveInt("WEBHOOK_MAX_ATTEMPTS", 8)
+	config.Webhook.IntervalSeconds = getEnvAsPositiveInt("WEBHOOK_INTERVAL_SECONDS", 5)
+
+	// Poller Config
+	config.Poller.IntervalSeconds = getEnvAsPositiveInt("POLLER_INTERVAL_SECONDS", 30)
+	config.Poller.Concurrency = getEnvAsPositiveInt("POLLER_CONCURRENCY", 4)
+	config.Poller.BatchSize = getEnvAsPositiveInt("POLLER_BATCH_SIZE", 100)
+	config.Poller.BaseBackoffSeconds = getEnvAsPositiveInt("POLLER_BASE_BACKOFF_SECONDS", 15)
+	config.Poller.MaxBackoffSeconds = getEnvAsPositiveInt("POLLER_MAX_BACKOFF_SECONDS", 600)
+	config.Poller.ExpirySweepSeconds = getEnvAsPositiveInt("EXPIRY_SWEEP_INTERVAL_SECONDS", 60)
+
+	// Ebarimt Config
+	config.Ebarimt.Auto = getEnv("EBARIMT_AUTO", "false") == "true"
+	config.Ebarimt.DistrictCode = getEnv("EBARIMT_DISTRICT_CODE", "")
+	config.Ebarimt.MaxAttempts = getEnvAsPositiveInt("EBARIMT_MAX_ATTEMPTS", 10)
+	config.Ebarimt.IntervalSeconds = getEnvAsPositiveInt("EBARIMT_INTERVAL_SECONDS", 30)
+
+	// Reconciliation Config
+	config.Reconcile.AutoFix = getEnv("RECONCILE_AUTO_FIX", "false") == "true"
+	config.Reconcile.Hour = getEnvAsInt("RECONCILE_HOUR", 6)
+
+	// Reports Config
+	config.Reports.SettlementEmails = getEnvAsList("SETTLEMENT_REPORT_EMAILS")
+	config.Reports.SettlementHour = getEnvAsInt("SETTLEMENT_REPORT_HOUR", 8)
+	config.Reports.SettlementDays = getEnvAsPositiveInt("SETTLEMENT_REPORT_DAYS", 1)
+
+	// QR Config
+	config.QR.LogoPath = getEnv("QR_LOGO_PATH", "")
+
+	// Rate Limit Config
+	config.RateLimit.Store = getEnv("RATE_LIMIT_STORE", "memory")
+	config.RateLimit.PerMinute = getEnvAsInt("RATE_LIMIT_PER_MINUTE", 120)
+	config.RateLimit.Burst = getEnvAsInt("RATE_LIMIT_BURST", 60)
+	config.RateLimit.IPPerMinute = getEnvAsInt("RATE_LIMIT_IP_PER_MINUTE", 600)
+	config.RateLimit.IPBurst = getEnvAsInt("RATE_LIMIT_IP_BURST", 200)
+	config.RateLimit.Routes = getEnvAsList("RATE_LIMIT_ROUTES")
 
 	// Application Config
 	config.App.Timeout = getEnvAsInt("TIMEOUT", 10)
 	config.App.Timezone = getEnv("TIMEZONE", "Asia/Ulaanbaatar")
 	config.App.URL = getEnv("URL", "http://localhost:1324")
 	config.App.AllowedIPs = getEnv("ALLOWED_IPS", "127.0.0.1")
-	config.App.APIKey = getEnv("API_KEY", "default-api-key")
+	config.App.APIKey = getEnv("API_KEY", "")
 
 	AppConfig = config
 	log.Info().Msg("✅ Configuration loaded successfully")
@@ -87,6 +184,16 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvAsList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func getEnvAsInt(key string, defaultValue int) int {
 	valueStr := getEnv(key, "")
 	if value, err := strconv.Atoi(valueStr); err == nil {
@@ -95,6 +202,17 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvAsPositiveInt falls back to defaultValue for values below one, which
+// would stop tickers and workers from running.
+func getEnvAsPositiveInt(key string, defaultValue int) int {
+	value := getEnvAsInt(key, defaultValue)
+	if value < 1 {
+		log.Warn().Msgf("⚠️  %v must be positive, using %v", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
 func SetLogger() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
@@ -12,18 +12,11 @@ import (
 
 var DB *gorm.DB
 
-// ConnectDatabase initializes the database connection
-func ConnectDatabase() {
-	// Ensure AppConfig is not nil
-	if AppConfig == nil {
-		log.Fatal().Msg("❌ AppConfig is nil. Did you call LoadConfig() before ConnectDatabase()?")
-		return
-	}
-
+// DatabaseDSN formats the PostgreSQL DSN from AppConfig. It is shared by
+// GORM and the dedicated LISTEN connection.
+func DatabaseDSN() string {
 	config := AppConfig
-
-	// Format DSN for PostgreSQL
-	dsn := fmt.Sprintf(
+	return fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%d sslmode=disable",
 		config.Database.Host,
 		config.Database.User,
@@ -31,9 +24,18 @@ func ConnectDatabase() {
 		config.Database.DBName,
 		config.Database.Port, // Ensure this is an integer
 	)
+}
+
+// ConnectDatabase initializes the database connection
+func ConnectDatabase() {
+	// Ensure AppConfig is not nil
+	if AppConfig == nil {
+		log.Fatal().Msg("❌ AppConfig is nil. Did you call LoadConfig() before ConnectDatabase()?")
+		return
+	}
 
 	// Open GORM database connection
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(DatabaseDSN()), &gorm.Config{})
 	if err != nil {
 		log.Fatal().Msgf("❌ Failed to connect to database: %v", err)
 	}
@@ -49,9 +51,9 @@ func ConnectDatabase() {
 	}
 
 	// Set database connection pool settings
-	sqlDB.SetMaxOpenConns(20)                     // Maximum open connections
-	sqlDB.SetMaxIdleConns(10)                     // Maximum idle connections
-	sqlDB.SetConnMaxLifetime(30 * time.Minute)    // Connection max lifetime
+	sqlDB.SetMaxOpenConns(20)                  // Maximum open connections
+	sqlDB.SetMaxIdleConns(10)                  // Maximum idle connections
+	sqlDB.SetConnMaxLifetime(30 * time.Minute) // Connection max lifetime
 
 	// Assign to global DB variable
 	DB = db
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"qpay/models"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// APIKeyBody creates an API key. MerchantID defaults to the default
+// merchant; admin keys act for every merchant whatever it is. Without
+// ratePerMinute and rateBurst the key gets the default rate limit.
+type APIKeyBody struct {
+	Name          string     `json:"name"`
+	MerchantID    uuid.UUID  `json:"merchantID"`
+	Scopes        []string   `json:"scopes"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	RatePerMinute int        `json:"ratePerMinute"`
+	RateBurst     int        `json:"rateBurst"`
+}
+
+func ListAPIKeys(c echo.Context) error {
+	merchantID, err := merchantScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	keys, err := models.ListAPIKeys(c.Request().Context(), merchantID)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list API keys")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"apiKeys": keys}})
+}
+
+// CreateAPIKey stores a key and returns it. The key is only shown once,
+// just its hash is kept.
+func CreateAPIKey(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var body APIKeyBody
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: err.Error()})
+	}
+	if body.Name == "" {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: "name is required"})
+	}
+	scopes, err := models.ParseScopes(body.Scopes)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: "expiresAt must be in the future"})
+	}
+
+	if body.RatePerMinute < 0 || body.RateBurst < 0 || (body.RatePerMinute == 0) != (body.RateBurst == 0) {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: "ratePerMinute and rateBurst must be positive and given together"})
+	}
+
+	merchant := models.Merchant{ID: body.MerchantID}
+	if err = merchant.Read(ctx); err != nil {
+		return merchantError(c, err)
+	}
+
+	apiKey := models.APIKey{
+		Name:          body.Name,
+		MerchantID:    merchant.ID,
+		Scopes:        scopes,
+		ExpiresAt:     body.ExpiresAt,
+		RatePerMinute: body.RatePerMinute,
+		RateBurst:     body.RateBurst,
+	}
+	key, err := apiKey.Create(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create API key")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, response{
+		Message: "Success",
+		Data:    &echo.Map{"apiKey": apiKey, "key": key}})
+}
+
+// RotateAPIKey replaces the key keeping its name, scopes and expiry. The
+// old key stops working immediately.
+func RotateAPIKey(c echo.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: "Invalid API key ID"})
+	}
+
+	apiKey := models.APIKey{ID: id}
+	key, err := apiKey.Rotate(c.Request().Context())
+	if errors.Is(err, models.ErrAPIKeyNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not rotate API key %v", id)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"apiKey": apiKey, "key": key}})
+}
+
+func RevokeAPIKey(c echo.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: "Invalid API key ID"})
+	}
+
+	apiKey := models.APIKey{ID: id}
+	err = apiKey.Revoke(c.Request().Context())
+	if errors.Is(err, models.ErrAPIKeyNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not revoke API key %v", id)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrDelete.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"apiKey": apiKey}})
+}
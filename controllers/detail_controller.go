@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"qpay/models"
+	"qpay/money"
+	q "qpay/qpay"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// invoiceDetail is the invoice as shown to the frontend, with the QR data
+// decoded from the stored QPay reply.
+type invoiceDetail struct {
+	*models.Invoice
+	PaidTotal money.Amount             `json:"paidTotal"`
+	QrText    string                   `json:"qrText"`
+	QrImage   string                   `json:"qrImage"`
+	ShortURL  string                   `json:"shortUrl,omitempty"`
+	URLs      []q.Deeplink             `json:"urls"`
+	Webhooks  []models.WebhookDelivery `json:"webhooks"`
+}
+
+// GetInvoiceDetail returns the full invoice record. QPay is only asked for
+// payments when refresh=true and the invoice is still open.
+func GetInvoiceDetail(c echo.Context) error {
+	ctx := c.Request().Context()
+	invoice := models.Invoice{
+		InvoiceID: c.Param("invoiceID"),
+	}
+
+	err := readInvoice(c, &invoice)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	if c.QueryParam("refresh") == "true" && invoice.IsOpen() {
+		if err = refreshInvoice(c, &invoice); err != nil {
+			log.Error().Err(err).Msgf("Could not refresh invoice %v", invoice.InvoiceID)
+			return c.JSON(http.StatusBadGateway, errResponse{
+				Code:    ErrQpay.Code,
+				Message: err.Error()})
+		}
+	}
+
+	detail := invoiceDetail{Invoice: &invoice}
+	if detail.Payments, err = invoice.ListPayments(ctx); err == nil {
+		detail.PaidTotal, err = invoice.PaidTotal(ctx)
+	}
+	if err == nil {
+		detail.Webhooks, err = invoice.ListWebhookDeliveries(ctx)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read invoice details")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	res, err := invoice.QpayResponse()
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not decode stored response of %v", invoice.InvoiceID)
+	} else {
+		detail.QrText = res.QrText
+		detail.QrImage = res.QrImage
+		detail.ShortURL = res.QPayShortURL
+		detail.URLs = res.URLs
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"invoice": detail}})
+}
+
+func refreshInvoice(c echo.Context, invoice *models.Invoice) error {
+	qpayClient, err := invoice.Client(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	check, err := qpayClient.CheckInvoice(invoice.InvoiceID)
+	if err != nil {
+		return err
+	}
+	return invoice.ApplyPaymentCheck(c.Request().Context(), check, requestActor(c))
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"qpay/models"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// GetEbarimt returns the VAT receipt of a payment with its lottery number
+// and QR data.
+func GetEbarimt(c echo.Context) error {
+	ebarimt := models.Ebarimt{
+		PaymentID: c.Param("paymentID"),
+	}
+
+	err := ebarimt.ReadForPaymentID(c.Request().Context())
+	if err == nil {
+		invoice := models.Invoice{ID: ebarimt.InvoiceID}
+		if err = invoice.Read(c.Request().Context()); err == nil && !ownsInvoice(c, &invoice) {
+			err = models.ErrEbarimtNotFound
+		}
+	}
+	if errors.Is(err, models.ErrEbarimtNotFound) || errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read ebarimt: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"ebarimt": ebarimt}})
+}
+
+// CreateEbarimt issues the VAT receipt of a paid payment, or retries a
+// failed one. The receiver defaults to the one given with the invoice.
+// An issued receipt is returned as is.
+func CreateEbarimt(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var body EbarimtBody
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: err.Error()})
+	}
+
+	payment := models.Payment{
+		PaymentID: c.Param("paymentID"),
+	}
+	err := payment.ReadForPaymentID(ctx)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read payment: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	invoice := models.Invoice{ID: payment.InvoiceID}
+	err = invoice.Read(ctx)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && !ownsInvoice(c, &invoice)) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: models.ErrNotFound.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice of payment %v", payment.PaymentID)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+	if payment.Status != models.PaymentPaid {
+		return c.JSON(http.StatusConflict, ErrPaymentNotPaid)
+	}
+
+	ebarimt := models.Ebarimt{
+		PaymentID:    payment.PaymentID,
+		InvoiceID:    invoice.ID,
+		ReceiverType: invoice.EbarimtReceiverType,
+		Receiver:     invoice.EbarimtReceiver,
+	}
+	if body.ReceiverType != "" || body.Receiver != "" {
+		if err = body.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, errResponse{
+				Code:    ErrValidation.Code,
+				Message: err.Error()})
+		}
+		ebarimt.ReceiverType = body.ReceiverType
+		ebarimt.Receiver = body.Receiver
+	}
+
+	if err = ebarimt.Retry(ctx); err != nil {
+		log.Error().Err(err).Msgf("Could not queue ebarimt of payment %v", payment.PaymentID)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error()})
+	}
+
+	if ebarimt.Status != models.EbarimtIssued {
+		if err = ebarimt.Issue(ctx); err != nil {
+			log.Error().Err(err).Msgf("Could not issue ebarimt of payment %v", payment.PaymentID)
+			return c.JSON(http.StatusBadGateway, errResponse{
+				Code:    ErrQpay.Code,
+				Message: err.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"ebarimt": ebarimt}})
+}
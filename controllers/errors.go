@@ -3,12 +3,26 @@ package controllers
 import "errors"
 
 var (
-	ErrBind errResponse = errResponse{Code: "9001", Message: "Invalid body"}
+	ErrBind       errResponse = errResponse{Code: "9001", Message: "Invalid body"}
+	ErrValidation errResponse = errResponse{Code: "9002", Message: "Validation error"}
 
 	ErrCreate errResponse = errResponse{Code: "8001", Message: "Create error"}
 	ErrRead   errResponse = errResponse{Code: "8002", Message: "Read error"}
 	ErrUpdate errResponse = errResponse{Code: "8003", Message: "Update error"}
 	ErrDelete errResponse = errResponse{Code: "8004", Message: "Delete error"}
+
+	ErrInvoicePaid    errResponse = errResponse{Code: "8101", Message: "Invoice is already paid"}
+	ErrInvoiceNotPaid errResponse = errResponse{Code: "8102", Message: "Invoice is not paid"}
+	ErrIllegalState   errResponse = errResponse{Code: "8103", Message: "Illegal invoice state"}
+	ErrStale          errResponse = errResponse{Code: "8104", Message: "Invoice was modified concurrently, retry the request"}
+
+	ErrInvoiceConflict     errResponse = errResponse{Code: "8201", Message: "Invoice number already used with a different request"}
+	ErrIdempotencyMismatch errResponse = errResponse{Code: "8202", Message: "Idempotency-Key already used with a different request"}
+	ErrInvoiceBusy         errResponse = errResponse{Code: "8203", Message: "Invoice is being changed by a concurrent request, retry the request"}
+
+	ErrPaymentNotPaid errResponse = errResponse{Code: "8301", Message: "Payment is not paid"}
+
+	ErrQpay errResponse = errResponse{Code: "7001", Message: "QPay error"}
 )
 
 var ErrAssertion = errors.New("not asserted")
@@ -2,13 +2,13 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"os"
 	"qpay/helpers"
 	"qpay/models"
-	q "qpay/qpay"
 	"strconv"
 	"time"
 
@@ -17,139 +17,357 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-type RequestBody struct {
-	Amount              float64 `json:"amount"`
-	InvoiceNumber       string  `json:"invoiceNumber"`
-	InvoiceReceiverCode string  `json:"invoiceReceiverCode"`
-	CallbackURL         string  `json:"callbackURL"`
-}
+// IdempotencyHeader lets clients retry a create safely: replays with the
+// same key and body return the original invoice.
+const IdempotencyHeader = "Idempotency-Key"
 
 func CreateInvoice(c echo.Context) error {
-    realIP := c.RealIP()
-
-    // Bind request body
-    var requestBody RequestBody
-    if err := c.Bind(&requestBody); err != nil {
-        log.Error().Err(err).Msg("Failed to bind request")
-        return c.JSON(http.StatusBadRequest, errResponse{
-            Code:    ErrBind.Code,
-            Message: err.Error(),
-        })
-    }
-
-    createSendInvoice := func() (map[string]interface{}, error) {
-        expireSecondsEnv := os.Getenv("QPAY_INVOICE_EXPIRE_SECONDS")
-        if expireSecondsEnv == "" {
-            expireSecondsEnv = "600"
-        }
-
-        expireSeconds, err := strconv.Atoi(expireSecondsEnv)
-        if err != nil {
-            log.Error().Err(err).Msg("Invalid expiry seconds")
-            return nil, err
-        }
-
-        expiryDate := time.Now().Add(time.Duration(expireSeconds) * time.Second)
-        convertedExpiryDate, _ := helpers.ConvertDatetimeToTimezone(expiryDate)
-
-        invoice := models.Invoice{
-            ID:            uuid.New(),
-            IpAddress:     realIP,
-            CalledAt:      time.Now(),
-            State:         models.Unpaid,
-            CallbackURL:   requestBody.CallbackURL,
-            InvoiceNumber: requestBody.InvoiceNumber,
-            ExpireAt:      &expiryDate,
-        }
-
-        qpayClient, err := q.NewClient()
-        if err != nil {
-            log.Error().Err(err).Msg("Failed to create QPay client")
-            return nil, err
-        }
-
-        // Create invoice request to QPay
-        req, res, err := qpayClient.CreateInvoice(
-            requestBody.Amount,
-            requestBody.InvoiceNumber,
-            requestBody.InvoiceReceiverCode,
-            invoice.GenerateCallbackURL(),
-            convertedExpiryDate,
-        )
-        if err != nil {
-            log.Error().Err(err).Msg("Failed to create QPay invoice")
-            return nil, err
-        }
-
-        invoiceID, ok := res["invoice_id"].(string)
-        if !ok {
-            log.Error().Msgf("Failed to retrieve invoice ID from QPay response: %v", res)
-            return nil, ErrAssertion
-        }
-
-        jsonReq, err := json.Marshal(req)
-        if err != nil {
-            log.Error().Err(err).Msg("Failed to marshal request JSON")
-            return nil, err
-        }
-
-        jsonRes, err := json.Marshal(res)
-        if err != nil {
-            log.Error().Err(err).Msg("Failed to marshal response JSON")
-            return nil, err
-        }
-
-        log.Info().Msgf("Invoice created: %v", invoiceID)
-        invoice.Request = jsonReq
-        invoice.Response = jsonRes
-        invoice.InvoiceID = invoiceID
-
-        // Save the invoice to the database
-        if err = invoice.Create(c.Request().Context()); err != nil {
-            log.Error().Err(err).Msg("Failed to save invoice to database")
-            return nil, err
-        }
-
-        return res, nil
-    }
-
-    var res map[string]interface{}
-    existingInvoice := models.Invoice{
-        InvoiceNumber: requestBody.InvoiceNumber,
-    }
-    err := existingInvoice.ReadForInvoiceNumber(c.Request().Context())
-
-    if errors.Is(err, models.ErrNotFound) {
-        // ✅ Invoice not found → Proceed with creating a new one
-        log.Info().Msgf("Invoice not found, creating new one: %s", requestBody.InvoiceNumber)
-        res, err = createSendInvoice()
-        if err != nil {
-            return c.JSON(http.StatusBadRequest, errResponse{
-                Code:    ErrCreate.Code,
-                Message: err.Error(),
-            })
-        }
-    } else if err != nil {
-        // ❌ Unexpected database error → Return 500
-        log.Error().Err(err).Msg("Database error while checking existing invoice")
-        return c.JSON(http.StatusInternalServerError, errResponse{
-            Code:    "201",
-            Message: "Database error",
-        })
-    } else {
-        // ✅ Invoice exists → Return existing invoice response
-        if err := json.Unmarshal(existingInvoice.Response, &res); err != nil {
-            log.Error().Err(err).Msg("Failed to unmarshal existing invoice response")
-            return c.JSON(http.StatusInternalServerError, errResponse{
-                Code:    "200",
-                Message: "Failed to process existing invoice data",
-            })
-        }
-    }
-
-    return c.JSON(http.StatusOK, res)
+	// Bind request body
+	var requestBody RequestBody
+	if err := c.Bind(&requestBody); err != nil {
+		log.Error().Err(err).Msg("Failed to bind request")
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: err.Error(),
+		})
+	}
+	if err := requestBody.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error(),
+		})
+	}
+
+	idempotencyKey := c.Request().Header.Get(IdempotencyHeader)
+	if len(idempotencyKey) > 255 {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: IdempotencyHeader + " must not exceed 255 characters",
+		})
+	}
+
+	// keys and invoice numbers are scoped by merchant
+	merchant := requestMerchant(c)
+	if idempotencyKey != "" {
+		idempotencyKey = merchant.ID.String() + ":" + idempotencyKey
+	}
+
+	// concurrent requests for the same key or order wait for each other,
+	// across replicas, so only one QPay invoice is created
+	locks := []string{"invoice:" + merchant.ID.String() + ":" + requestBody.InvoiceNumber}
+	if idempotencyKey != "" {
+		locks = append([]string{"idempotency:" + idempotencyKey}, locks...)
+	}
+
+	ctx := c.Request().Context()
+	fingerprint := requestBody.Fingerprint()
+
+	// the locked section only reads and reserves; QPay is called after it
+	// commits so no connection waits on HTTP
+	var r *reply
+	var previous *models.Invoice
+	err := models.WithLocks(ctx, locks, func(ctx context.Context) (err error) {
+		r, previous, err = reserveInvoice(ctx, merchant, &requestBody, fingerprint, idempotencyKey)
+		return
+	})
+	if errors.Is(err, models.ErrLockTimeout) || errors.Is(err, models.ErrInvoiceReserved) {
+		return c.JSON(http.StatusConflict, ErrInvoiceBusy)
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not reserve invoice %v", requestBody.InvoiceNumber)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error(),
+		})
+	}
+	if r == nil {
+		r = issueInvoice(ctx, c, merchant, &requestBody, fingerprint, idempotencyKey, locks, previous)
+	}
+	return c.JSON(r.status, r.body)
+}
+
+// reply is a response decided before it is written, so nothing reaches the
+// client before the transaction it depends on commits.
+type reply struct {
+	status int
+	body   interface{}
+}
+
+// reserveInvoice runs under the locks of CreateInvoice and answers from the
+// stored invoices when it can. Otherwise it reserves the invoice number and
+// returns a nil reply, with the invoice to replace if there is one.
+func reserveInvoice(ctx context.Context, merchant *models.Merchant, requestBody *RequestBody, fingerprint, idempotencyKey string) (*reply, *models.Invoice, error) {
+	// 🔁 Known idempotency key → Replay the original invoice
+	if idempotencyKey != "" {
+		key := models.IdempotencyKey{Key: idempotencyKey}
+		err := key.Read(ctx)
+		if err == nil {
+			if key.Fingerprint != fingerprint {
+				return &reply{http.StatusConflict, ErrIdempotencyMismatch}, nil, nil
+			}
+			invoice := models.Invoice{ID: key.InvoiceID}
+			if err = invoice.Read(ctx); err != nil {
+				log.Error().Err(err).Msg("Could not read idempotent invoice")
+				return &reply{http.StatusInternalServerError, errResponse{
+					Code:    ErrRead.Code,
+					Message: err.Error(),
+				}}, nil, nil
+			}
+			return &reply{http.StatusOK, json.RawMessage(invoice.Response)}, nil, nil
+		} else if !errors.Is(err, models.ErrIdempotencyKeyNotFound) {
+			log.Error().Err(err).Msg("Database error while checking idempotency key")
+			return &reply{http.StatusInternalServerError, errResponse{
+				Code:    "201",
+				Message: "Database error",
+			}}, nil, nil
+		}
+	}
+
+	existingInvoice := models.Invoice{
+		MerchantID:    merchant.ID,
+		InvoiceNumber: requestBody.InvoiceNumber,
+	}
+	err := existingInvoice.ReadForInvoiceNumber(ctx)
+
+	var previous *models.Invoice
+	if errors.Is(err, models.ErrNotFound) {
+		// ✅ Invoice not found → Proceed with creating a new one
+		log.Info().Msgf("Invoice not found, creating new one: %s", requestBody.InvoiceNumber)
+	} else if err != nil {
+		// ❌ Unexpected database error → Return 500
+		log.Error().Err(err).Msg("Database error while checking existing invoice")
+		return &reply{http.StatusInternalServerError, errResponse{
+			Code:    "201",
+			Message: "Database error",
+		}}, nil, nil
+	} else if existingInvoice.NeedsReissue() {
+		// ♻️ Invoice expired or cancelled → Replace it with a fresh one
+		log.Info().Msgf("Invoice %s can not be paid as is, reissuing", requestBody.InvoiceNumber)
+		previous = &existingInvoice
+	} else if !existingInvoice.Matches(fingerprint, requestBody.Amount) {
+		// ❌ Same invoice number with a different payload → Return 409
+		return &reply{http.StatusConflict, ErrInvoiceConflict}, nil, nil
+	} else {
+		// ✅ Invoice exists → Return existing invoice response
+		if idempotencyKey != "" {
+			key := models.IdempotencyKey{Key: idempotencyKey, Fingerprint: fingerprint, InvoiceID: existingInvoice.ID}
+			if err = key.Create(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		return invoiceReply(&existingInvoice), nil, nil
+	}
+
+	if err = models.ReserveInvoice(ctx, merchant.ID, requestBody.InvoiceNumber, idempotencyKey); err != nil {
+		return nil, nil, err
+	}
+	return nil, previous, nil
 }
 
+// issueInvoice creates the reserved invoice at QPay, replacing previous
+// when given, then stores it with its idempotency key under the locks of
+// CreateInvoice and releases the reservation.
+func issueInvoice(ctx context.Context, c echo.Context, merchant *models.Merchant, requestBody *RequestBody, fingerprint, idempotencyKey string, locks []string, previous *models.Invoice) *reply {
+	release := func() {
+		if err := models.ReleaseInvoice(context.WithoutCancel(ctx), merchant.ID, requestBody.InvoiceNumber); err != nil {
+			log.Error().Err(err).Msgf("Could not release invoice %v", requestBody.InvoiceNumber)
+		}
+	}
+
+	if previous != nil {
+		paid, err := retireInvoice(ctx, previous, requestActor(c))
+		if err != nil {
+			release()
+			return &reply{http.StatusBadGateway, errResponse{
+				Code:    ErrQpay.Code,
+				Message: err.Error(),
+			}}
+		}
+		if paid {
+			release()
+			return &reply{http.StatusConflict, ErrInvoicePaid}
+		}
+	}
+
+	invoice, err := createQpayInvoice(c, merchant, requestBody, fingerprint)
+	if err != nil {
+		release()
+		return &reply{http.StatusBadRequest, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error(),
+		}}
+	}
+
+	// the QPay invoice exists now, so it is saved even if the client left
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), invoiceSaveTimeout)
+	defer cancel()
+	err = models.WithLocks(saveCtx, locks, func(ctx context.Context) error {
+		var err error
+		if previous != nil {
+			err = invoice.CreateReplacing(ctx, previous, requestActor(c))
+		} else {
+			err = invoice.Create(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if idempotencyKey != "" {
+			key := models.IdempotencyKey{Key: idempotencyKey, Fingerprint: fingerprint, InvoiceID: invoice.ID}
+			if err = key.Create(ctx); err != nil {
+				return err
+			}
+		}
+		return models.ReleaseInvoice(ctx, merchant.ID, requestBody.InvoiceNumber)
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to save invoice %v, cancelling it at QPay", invoice.InvoiceID)
+		if qpayClient, cerr := merchant.Client(); cerr == nil {
+			if cerr = qpayClient.CancelInvoice(invoice.InvoiceID); cerr != nil {
+				log.Error().Err(cerr).Msgf("Could not cancel unsaved qpay invoice %v", invoice.InvoiceID)
+			}
+		}
+		release()
+		return &reply{http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error(),
+		}}
+	}
+	return invoiceReply(invoice)
+}
+
+// invoiceSaveTimeout bounds storing an invoice QPay already created.
+const invoiceSaveTimeout = 10 * time.Second
+
+// invoiceReply returns the stored QPay response of the invoice.
+func invoiceReply(invoice *models.Invoice) *reply {
+	res, err := invoice.QpayResponse()
+	if err != nil || res.InvoiceID == "" {
+		log.Error().Err(err).Msg("Failed to unmarshal existing invoice response")
+		return &reply{http.StatusInternalServerError, errResponse{
+			Code:    "200",
+			Message: "Failed to process existing invoice data",
+		}}
+	}
+	return &reply{http.StatusOK, res}
+}
+
+// createQpayInvoice creates the invoice of the request at QPay. It is not
+// stored yet.
+func createQpayInvoice(c echo.Context, merchant *models.Merchant, requestBody *RequestBody, fingerprint string) (*models.Invoice, error) {
+	expireSecondsEnv := os.Getenv("QPAY_INVOICE_EXPIRE_SECONDS")
+	if expireSecondsEnv == "" {
+		expireSecondsEnv = "600"
+	}
+
+	expireSeconds, err := strconv.Atoi(expireSecondsEnv)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid expiry seconds")
+		return nil, err
+	}
+
+	expiryDate := time.Now().Add(time.Duration(expireSeconds) * time.Second)
+	convertedExpiryDate, _ := helpers.ConvertDatetimeToTimezone(expiryDate)
+
+	invoice := models.Invoice{
+		ID:            uuid.New(),
+		MerchantID:    merchant.ID,
+		IpAddress:     c.RealIP(),
+		CalledAt:      time.Now(),
+		State:         models.Unpaid,
+		CallbackURL:   requestBody.CallbackURL,
+		ReturnURL:     requestBody.ReturnURL,
+		InvoiceNumber: requestBody.InvoiceNumber,
+		ReceiverCode:  requestBody.InvoiceReceiverCode,
+		Amount:        requestBody.Amount,
+		Currency:      requestBody.Currency,
+		Fingerprint:   fingerprint,
+		ExpireAt:      &expiryDate,
+	}
+
+	if invoice.CallbackURL == "" {
+		invoice.CallbackURL = merchant.CallbackURL
+	}
+	if invoice.ReturnURL == "" {
+		invoice.ReturnURL = merchant.ReturnURL
+	}
+	if requestBody.Ebarimt != nil {
+		invoice.EbarimtReceiverType = requestBody.Ebarimt.ReceiverType
+		invoice.EbarimtReceiver = requestBody.Ebarimt.Receiver
+	}
+
+	qpayClient, err := merchant.Client()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create QPay client")
+		return nil, err
+	}
+
+	// Create invoice request to QPay
+	req := requestBody.toQpay()
+	req.CallbackURL = invoice.GenerateCallbackURL()
+	req.ExpiryDate = convertedExpiryDate.Format("2006-01-02 15:04:05")
+	res, err := qpayClient.CreateInvoice(req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create QPay invoice")
+		return nil, err
+	}
+	invoiceID := res.InvoiceID
+
+	jsonReq, err := json.Marshal(req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal request JSON")
+		return nil, err
+	}
+
+	jsonRes, err := json.Marshal(res)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal response JSON")
+		return nil, err
+	}
+
+	log.Info().Msgf("Invoice created: %v", invoiceID)
+	invoice.Request = jsonReq
+	invoice.Response = jsonRes
+	invoice.InvoiceID = invoiceID
+	return &invoice, nil
+}
+
+// retireInvoice makes sure the invoice can be replaced: a last check picks
+// up late payments, then the QPay invoice is cancelled so it can not be paid
+// alongside its replacement.
+func retireInvoice(ctx context.Context, invoice *models.Invoice, actor models.Actor) (paid bool, err error) {
+	if invoice.State == models.Cancelled {
+		return
+	}
+
+	qpayClient, err := invoice.Client(ctx)
+	if err != nil {
+		return
+	}
+	check, err := qpayClient.CheckInvoice(invoice.InvoiceID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not check qpay invoice: %v", invoice.InvoiceID)
+		return
+	}
+	if check.IsPaid() {
+		if err = invoice.ApplyPaymentCheck(ctx, check, actor); err != nil {
+			return
+		}
+		return true, nil
+	}
+
+	if err = qpayClient.CancelInvoice(invoice.InvoiceID); err != nil {
+		if !invoice.IsExpired() {
+			log.Error().Err(err).Msgf("Could not cancel qpay invoice: %v", invoice.InvoiceID)
+			return
+		}
+		// QPay may refuse to cancel an invoice that already expired
+		log.Warn().Err(err).Msgf("Could not cancel expired qpay invoice: %v", invoice.InvoiceID)
+		err = nil
+	}
+	return
+}
+
+// Callback is called by QPay when a payment is made. The request itself is
+// not trusted: the payment is confirmed with QPay before the invoice moves.
 func Callback(c echo.Context) error {
 	callbackIDParam := c.Param("callbackID")
 	callbackID, err := uuid.Parse(callbackIDParam)
@@ -158,20 +376,48 @@ func Callback(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid callback ID")
 	}
 
-	var invoice models.Invoice
-	err = models.DB.First(&invoice, "id = ?", callbackID).Error
-	if err != nil {
+	invoice := models.Invoice{ID: callbackID}
+	if err = invoice.Read(c.Request().Context()); err != nil {
 		log.Error().Err(err).Msg("Invoice not found")
 		return echo.ErrNotFound
 	}
 
-	invoice.State = models.Paid
-	if err = models.DB.Save(&invoice).Error; err != nil {
+	paymentID := c.QueryParam("qpay_payment_id")
+	if paymentID == "" {
+		paymentID = c.QueryParam("payment_id")
+	}
+
+	// repeated callbacks for a settled invoice are acknowledged as is
+	if invoice.State == models.Paid {
+		return c.String(http.StatusOK, "SUCCESS")
+	}
+
+	qpayClient, err := invoice.Client(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get qpay client")
+		return echo.ErrInternalServerError
+	}
+	check, err := qpayClient.CheckInvoice(invoice.InvoiceID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not verify callback for invoice %v", invoice.InvoiceID)
+		return echo.ErrBadGateway
+	}
+	if paymentID != "" && !models.HasPayment(check, paymentID) {
+		log.Warn().Msgf("Callback payment %v not reported by QPay for invoice %v", paymentID, invoice.InvoiceID)
+		if err = invoice.Flag(c.Request().Context(), paymentID, models.FlagUnknownPayment); err != nil {
+			log.Error().Err(err).Msgf("Could not flag payment %v for reconciliation", paymentID)
+		}
+	}
+
+	if err = invoice.ApplyPaymentCheck(c.Request().Context(), check, models.ActorCallback); err != nil {
 		log.Error().Err(err).Msg("Failed to update invoice status")
 		return echo.ErrInternalServerError
 	}
 
-	invoice.CallCallbackURL()
+	if invoice.State != models.Paid {
+		log.Warn().Msgf("Callback for invoice %v without sufficient payment, state: %v", invoice.InvoiceID, invoice.State)
+		return c.String(http.StatusOK, "NOT PAID")
+	}
 	return c.String(http.StatusOK, "SUCCESS")
 }
 
@@ -182,7 +428,7 @@ func CheckInvoice(c echo.Context) error {
 		InvoiceID: invoiceIdParam,
 	}
 
-	err := invoice.ReadForInvoiceID(c.Request().Context())
+	err := readInvoice(c, &invoice)
 	if err != nil {
 		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
 		return c.JSON(http.StatusBadRequest, errResponse{
@@ -197,14 +443,14 @@ func CheckInvoice(c echo.Context) error {
 	}
 
 	// sending check invoice request
-	qpayClient, err := q.NewClient()
+	qpayClient, err := invoice.Client(c.Request().Context())
 	if err != nil {
 		log.Error().Err(err).Msgf("Could not get qpay client: %v", err.Error())
 		return c.JSON(http.StatusBadRequest, errResponse{
 			Code:    ErrBind.Code,
 			Message: err.Error()})
 	}
-	isPaid, paymentID, err := qpayClient.CheckInvoice(invoiceIdParam)
+	check, err := qpayClient.CheckInvoice(invoiceIdParam)
 	if err != nil {
 		log.Error().Err(err).Msgf("Could not check qpay invoice: %v", err.Error())
 		return c.JSON(http.StatusBadRequest, errResponse{
@@ -212,18 +458,129 @@ func CheckInvoice(c echo.Context) error {
 			Message: err.Error()})
 	}
 
-	// updating paid
-	if isPaid {
+	// storing payments and updating paid
+	if err = invoice.ApplyPaymentCheck(c.Request().Context(), check, requestActor(c)); err != nil {
+		log.Info().Err(err).Msg("Could not update invoice.")
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: "Could not update invoice"})
+	}
+	if invoice.State == models.Paid {
 		log.Info().Msgf("Invoice is paid: %v", invoiceIdParam)
-		err = invoice.UpdateForInvoiceNumber(c.Request().Context(), models.Invoice{State: models.Paid, PaymentID: paymentID})
-		if err != nil {
-			log.Info().Err(err).Msg("Could not update invoice.")
-			return c.JSON(http.StatusBadRequest, errResponse{
-				Code:    ErrUpdate.Code,
-				Message: "Could not update invoice"})
+	}
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"isPaid": invoice.State == models.Paid, "state": invoice.State}})
+}
+
+func CancelInvoice(c echo.Context) error {
+	invoiceIdParam := c.Param("invoiceID")
+	invoice := models.Invoice{
+		InvoiceID: invoiceIdParam,
+	}
+
+	err := readInvoice(c, &invoice)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	switch invoice.State {
+	case models.Cancelled:
+		return c.JSON(http.StatusOK, response{
+			Message: "Success",
+			Data:    &echo.Map{"state": invoice.State}})
+	case models.Paid, models.PartiallyPaid:
+		return c.JSON(http.StatusConflict, ErrInvoicePaid)
+	}
+	if !models.CanTransition(invoice.State, models.Cancelled) {
+		return c.JSON(http.StatusConflict, errResponse{
+			Code:    ErrIllegalState.Code,
+			Message: "Invoice can not be cancelled in state " + string(invoice.State)})
+	}
+
+	qpayClient, err := invoice.Client(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not get qpay client: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
+	}
+
+	// a payment may have landed after our last check, never void it
+	check, err := qpayClient.CheckInvoice(invoiceIdParam)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not check qpay invoice: %v", err.Error())
+		return c.JSON(http.StatusBadGateway, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
+	}
+	if check.IsPaid() {
+		if err = invoice.ApplyPaymentCheck(c.Request().Context(), check, requestActor(c)); err != nil {
+			log.Error().Err(err).Msg("Could not update invoice.")
 		}
+		return c.JSON(http.StatusConflict, ErrInvoicePaid)
+	}
+
+	if err = qpayClient.CancelInvoice(invoiceIdParam); err != nil {
+		log.Error().Err(err).Msgf("Could not cancel qpay invoice: %v", err.Error())
+		return c.JSON(http.StatusBadGateway, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
 	}
-    return c.JSON(http.StatusOK, response{
-        Message: "Success",
-        Data:    &echo.Map{"isPaid": invoice.State == models.Paid}})
+
+	err = invoice.Transition(c.Request().Context(), models.Transition{
+		To:     models.Cancelled,
+		Actor:  requestActor(c),
+		Reason: "cancelled via API",
+	})
+	if errors.Is(err, models.ErrStale) {
+		return c.JSON(http.StatusConflict, ErrStale)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Could not update invoice.")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: "Could not update invoice"})
+	}
+
+	log.Info().Msgf("Invoice cancelled: %v", invoiceIdParam)
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"state": invoice.State}})
+}
+
+func ListInvoiceEvents(c echo.Context) error {
+	invoice := models.Invoice{
+		InvoiceID: c.Param("invoiceID"),
+	}
+
+	err := readInvoice(c, &invoice)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	events, err := invoice.ListEvents(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list invoice events")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"state": invoice.State, "events": events}})
 }
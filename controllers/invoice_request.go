@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"qpay/config"
+	"qpay/money"
+	q "qpay/qpay"
+)
+
+// RequestBody is the body of POST /api/v1/invoices. Only amount and
+// invoiceNumber are required; the rest enables QPay's detailed invoice form.
+type RequestBody struct {
+	Amount              money.Amount      `json:"amount"`
+	Currency            string            `json:"currency"`
+	InvoiceNumber       string            `json:"invoiceNumber"`
+	InvoiceReceiverCode string            `json:"invoiceReceiverCode"`
+	CallbackURL         string            `json:"callbackURL"`
+	ReturnURL           string            `json:"returnURL"`
+	Description         string            `json:"description"`
+	SenderBranchCode    string            `json:"senderBranchCode"`
+	SenderStaffCode     string            `json:"senderStaffCode"`
+	ReceiverData        *ReceiverDataBody `json:"receiverData"`
+	Ebarimt             *EbarimtBody      `json:"ebarimt"`
+	AllowPartial        bool              `json:"allowPartial"`
+	MinimumAmount       money.Amount      `json:"minimumAmount"`
+	AllowExceed         bool              `json:"allowExceed"`
+	MaximumAmount       money.Amount      `json:"maximumAmount"`
+	Note                string            `json:"note"`
+	Lines               []InvoiceLineBody `json:"lines"`
+}
+
+type ReceiverDataBody struct {
+	Register string `json:"register"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+}
+
+// EbarimtBody is who the VAT receipt of the payments is issued to.
+// receiverType is CITIZEN or COMPANY; companies need their register number.
+type EbarimtBody struct {
+	ReceiverType q.EbarimtReceiverType `json:"receiverType"`
+	Receiver     string                `json:"receiver"`
+}
+
+// Validate defaults the receiver type to CITIZEN.
+func (e *EbarimtBody) Validate() error {
+	switch e.ReceiverType {
+	case "":
+		e.ReceiverType = q.EbarimtCitizen
+	case q.EbarimtCitizen:
+	case q.EbarimtCompany:
+		if e.Receiver == "" {
+			return errors.New("ebarimt: receiver register is required for COMPANY")
+		}
+	default:
+		return errors.New("ebarimt: receiverType must be CITIZEN or COMPANY")
+	}
+	return nil
+}
+
+type InvoiceLineBody struct {
+	TaxProductCode string           `json:"taxProductCode"`
+	Description    string           `json:"description"`
+	Quantity       float64          `json:"quantity"`
+	UnitPrice      money.Amount     `json:"unitPrice"`
+	Note           string           `json:"note"`
+	Discounts      []AdjustmentBody `json:"discounts"`
+	Surcharges     []AdjustmentBody `json:"surcharges"`
+	Taxes          []AdjustmentBody `json:"taxes"`
+}
+
+// AdjustmentBody is a discount, surcharge or tax on a line. Code maps to
+// discount_code, surcharge_code or tax_code depending on where it is used.
+type AdjustmentBody struct {
+	Code        string       `json:"code"`
+	Description string       `json:"description"`
+	Amount      money.Amount `json:"amount"`
+	Note        string       `json:"note"`
+}
+
+// Validate checks the fields QPay would otherwise reject with a less
+// helpful error.
+func (r *RequestBody) Validate() error {
+	if r.InvoiceNumber == "" {
+		return errors.New("invoiceNumber is required")
+	}
+	if err := r.Amount.Validate(money.FromTogrog(int64(config.AppConfig.QPay.MaxAmount))); err != nil {
+		return fmt.Errorf("amount: %w", err)
+	}
+	if r.Currency == "" {
+		r.Currency = money.MNT
+	} else if r.Currency != money.MNT {
+		return errors.New("currency must be MNT")
+	}
+	if r.AllowPartial && (r.MinimumAmount <= 0 || r.MinimumAmount > r.Amount) {
+		return errors.New("minimumAmount must be positive and not exceed amount when allowPartial is set")
+	}
+	if !r.AllowPartial && r.MinimumAmount != 0 {
+		return errors.New("minimumAmount requires allowPartial")
+	}
+	if r.AllowExceed && r.MaximumAmount != 0 && r.MaximumAmount < r.Amount {
+		return errors.New("maximumAmount must not be less than amount")
+	}
+	if !r.AllowExceed && r.MaximumAmount != 0 {
+		return errors.New("maximumAmount requires allowExceed")
+	}
+	if r.Ebarimt != nil {
+		if err := r.Ebarimt.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.ReturnURL != "" {
+		u, err := url.Parse(r.ReturnURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("returnURL must be an absolute http(s) URL")
+		}
+	}
+	for _, line := range r.Lines {
+		if line.Description == "" {
+			return errors.New("lines: description is required")
+		}
+		if line.Quantity <= 0 || line.UnitPrice < 0 {
+			return errors.New("lines: quantity must be positive and unitPrice must not be negative")
+		}
+	}
+	return nil
+}
+
+// Fingerprint identifies the request payload, so retries can be told apart
+// from conflicting requests for the same invoice number.
+func (r *RequestBody) Fingerprint() string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// toQpay maps the request body onto the QPay invoice payload. CallbackURL
+// and ExpiryDate are filled in by the caller.
+func (r *RequestBody) toQpay() *q.InvoiceRequest {
+	req := &q.InvoiceRequest{
+		SenderInvoiceNo:     r.InvoiceNumber,
+		SenderBranchCode:    r.SenderBranchCode,
+		SenderStaffCode:     r.SenderStaffCode,
+		InvoiceReceiverCode: r.InvoiceReceiverCode,
+		InvoiceDescription:  r.Description,
+		Amount:              r.Amount,
+		AllowPartial:        r.AllowPartial,
+		MinimumAmount:       r.MinimumAmount,
+		AllowExceed:         r.AllowExceed,
+		MaximumAmount:       r.MaximumAmount,
+		Note:                r.Note,
+	}
+	if req.InvoiceDescription == "" {
+		req.InvoiceDescription = r.InvoiceNumber
+	}
+
+	if r.ReceiverData != nil {
+		req.InvoiceReceiverData = &q.InvoiceReceiverData{
+			Register: r.ReceiverData.Register,
+			Name:     r.ReceiverData.Name,
+			Email:    r.ReceiverData.Email,
+			Phone:    r.ReceiverData.Phone,
+		}
+	}
+
+	for _, line := range r.Lines {
+		l := q.InvoiceLine{
+			TaxProductCode:  line.TaxProductCode,
+			LineDescription: line.Description,
+			LineQuantity:    line.Quantity,
+			LineUnitPrice:   line.UnitPrice,
+			Note:            line.Note,
+		}
+		for _, d := range line.Discounts {
+			l.Discounts = append(l.Discounts, q.Discount{DiscountCode: d.Code, Description: d.Description, Amount: d.Amount, Note: d.Note})
+		}
+		for _, s := range line.Surcharges {
+			l.Surcharges = append(l.Surcharges, q.Surcharge{SurchargeCode: s.Code, Description: s.Description, Amount: s.Amount, Note: s.Note})
+		}
+		for _, t := range line.Taxes {
+			l.Taxes = append(l.Taxes, q.Tax{TaxCode: t.Code, Description: t.Description, Amount: t.Amount, Note: t.Note})
+		}
+		req.Lines = append(req.Lines, l)
+	}
+	return req
+}
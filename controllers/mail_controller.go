@@ -1,17 +1,12 @@
 package controllers
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"qpay/helpers"
 
 	"github.com/labstack/echo/v4"
-	"gopkg.in/gomail.v2"
 )
 
 // EmailRequest contains complete order details
@@ -59,56 +54,18 @@ func SendConfirmedEmail(c echo.Context) error {
 
 // sendTemplatedEmail renders template and sends the email
 func sendTemplatedEmail(c echo.Context, to, subject, templateName string, data any) error {
-	emailBody, err := renderTemplate(templateName, data)
+	emailBody, err := helpers.RenderTemplate(templateName, data)
 	if err != nil {
 		return logAndRespond(c, "Render Template: "+templateName, err, http.StatusInternalServerError)
 	}
 
-	if err := sendMail(to, subject, emailBody); err != nil {
+	if err := helpers.SendMail([]string{to}, subject, emailBody); err != nil {
 		return logAndRespond(c, "Send Mail", err, http.StatusInternalServerError)
 	}
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Email sent successfully!"})
 }
 
-// renderTemplate loads and executes the given template
-func renderTemplate(filename string, data any) (string, error) {
-	tmplPath := filepath.Join("templates", filename)
-	tmpl, err := template.ParseFiles(tmplPath)
-	if err != nil {
-		return "", fmt.Errorf("template parse error: %w", err)
-	}
-
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("template execute error: %w", err)
-	}
-	return buf.String(), nil
-}
-
-// sendMail sends an email using SMTP
-func sendMail(to, subject, body string) error {
-	username, password, host, port := getSMTPConfig()
-	if username == "" || password == "" || host == "" {
-		return errors.New("missing SMTP credentials")
-	}
-
-	m := gomail.NewMessage()
-	m.SetHeader("From", username)
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
-
-	d := gomail.NewDialer(host, port, username, password)
-	d.SSL = true
-	return d.DialAndSend(m)
-}
-
-// getSMTPConfig reads SMTP credentials from environment
-func getSMTPConfig() (username, password, host string, port int) {
-	return os.Getenv("MAIL_USERNAME"), os.Getenv("MAIL_PASSWORD"), os.Getenv("SMTP_SERVER"), 465
-}
-
 // logAndRespond logs the error and sends JSON response
 func logAndRespond(c echo.Context, context string, err error, status int) error {
 	log.Printf("[%s] %v\n", context, err)
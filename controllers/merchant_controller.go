@@ -0,0 +1,327 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"qpay/models"
+	m "qpay/routes/middlewares"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// requestMerchant is the merchant invoices of the request are created for.
+// The admin key creates them for the default merchant.
+func requestMerchant(c echo.Context) *models.Merchant {
+	if merchant := m.Merchant(c); merchant != nil {
+		return merchant
+	}
+	return models.DefaultMerchant()
+}
+
+// requestActor is who the request's changes are recorded as: admin for
+// admin keys, api for merchant keys.
+func requestActor(c echo.Context) models.Actor {
+	if p := m.GetPrincipal(c); p != nil && p.Has(models.ScopeAdmin) {
+		return models.ActorAdmin
+	}
+	return models.ActorAPI
+}
+
+// readInvoice loads the invoice by its QPay invoice_id. Invoices of other
+// merchants are reported as not found.
+func readInvoice(c echo.Context, invoice *models.Invoice) error {
+	if err := invoice.ReadForInvoiceID(c.Request().Context()); err != nil {
+		return err
+	}
+	if !ownsInvoice(c, invoice) {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+// ownsInvoice reports whether the request's key may see the invoice.
+func ownsInvoice(c echo.Context, invoice *models.Invoice) bool {
+	merchant := m.Merchant(c)
+	return merchant == nil || merchant.ID == invoice.MerchantID
+}
+
+// merchantScopeOf is the merchant the request is limited to, nil for the
+// admin key.
+func merchantScopeOf(c echo.Context) *uuid.UUID {
+	if merchant := m.Merchant(c); merchant != nil {
+		return &merchant.ID
+	}
+	return nil
+}
+
+// merchantScope is merchantScopeOf where the admin key may narrow lists
+// and reports with the merchantID query parameter.
+func merchantScope(c echo.Context) (*uuid.UUID, error) {
+	if id := merchantScopeOf(c); id != nil {
+		return id, nil
+	}
+	v := c.QueryParam("merchantID")
+	if v == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(v)
+	if err != nil {
+		return nil, errInvalidMerchantID
+	}
+	return &id, nil
+}
+
+// reportMerchant is the merchant a report is built for: the key's own, the
+// merchantID the admin key asks for, or the default merchant.
+func reportMerchant(c echo.Context) (*models.Merchant, error) {
+	id, err := merchantScope(c)
+	if err != nil || id == nil {
+		return requestMerchant(c), err
+	}
+	if merchant := m.Merchant(c); merchant != nil {
+		return merchant, nil
+	}
+	merchant := &models.Merchant{ID: *id}
+	return merchant, merchant.Read(c.Request().Context())
+}
+
+// MerchantBody creates or updates a merchant. On update, empty fields are
+// left unchanged; username and password must be given together.
+type MerchantBody struct {
+	Name           string `json:"name"`
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	InvoiceCode    string `json:"invoiceCode"`
+	QpayMerchantID string `json:"qpayMerchantID"`
+	CallbackURL    string `json:"callbackURL"`
+	ReturnURL      string `json:"returnURL"`
+	Active         *bool  `json:"active"`
+}
+
+func (b *MerchantBody) validate(create bool) error {
+	if create && (b.Name == "" || b.InvoiceCode == "" || b.Username == "" || b.Password == "") {
+		return errors.New("name, invoiceCode, username and password are required")
+	}
+	if (b.Username == "") != (b.Password == "") {
+		return errors.New("username and password must be given together")
+	}
+	for _, v := range []string{b.CallbackURL, b.ReturnURL} {
+		if v == "" {
+			continue
+		}
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("callbackURL and returnURL must be absolute http(s) URLs")
+		}
+	}
+	return nil
+}
+
+func ListMerchants(c echo.Context) error {
+	merchants, err := models.ListMerchants(c.Request().Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list merchants")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"merchants": merchants}})
+}
+
+// CreateMerchant stores a merchant with a first API key granted the
+// merchant scopes and a webhook secret. Both are only shown once.
+func CreateMerchant(c echo.Context) error {
+	var body MerchantBody
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: err.Error()})
+	}
+	if err := body.validate(true); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	merchant := models.Merchant{
+		ID:             uuid.New(),
+		Name:           body.Name,
+		InvoiceCode:    body.InvoiceCode,
+		QpayMerchantID: body.QpayMerchantID,
+		CallbackURL:    body.CallbackURL,
+		ReturnURL:      body.ReturnURL,
+		Active:         body.Active == nil || *body.Active,
+	}
+	if err := merchant.SetCredentials(body.Username, body.Password); err != nil {
+		log.Error().Err(err).Msg("Could not encrypt merchant credentials")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error()})
+	}
+	webhookSecret, err := merchant.NewWebhookSecret()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create merchant webhook secret")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error()})
+	}
+	// the merchant is only stored together with its first key
+	apiKey := models.APIKey{
+		Name:       merchant.Name,
+		MerchantID: merchant.ID,
+		Scopes:     models.MerchantScopes,
+	}
+	var key string
+	err = models.Transaction(c.Request().Context(), func(ctx context.Context) (err error) {
+		if err = merchant.Create(ctx); err != nil {
+			return
+		}
+		key, err = apiKey.Create(ctx)
+		return
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create merchant")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrCreate.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, response{
+		Message: "Success",
+		Data:    &echo.Map{"merchant": merchant, "apiKey": apiKey, "key": key, "webhookSecret": webhookSecret}})
+}
+
+func GetMerchant(c echo.Context) error {
+	merchant, err := readMerchant(c)
+	if err != nil {
+		return merchantError(c, err)
+	}
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"merchant": merchant}})
+}
+
+func UpdateMerchant(c echo.Context) error {
+	merchant, err := readMerchant(c)
+	if err != nil {
+		return merchantError(c, err)
+	}
+
+	var body MerchantBody
+	if err = c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: err.Error()})
+	}
+	if err = body.validate(false); err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	var columns []string
+	set := func(column string, dst *string, v string) {
+		if v != "" {
+			*dst = v
+			columns = append(columns, column)
+		}
+	}
+	set("name", &merchant.Name, body.Name)
+	set("invoice_code", &merchant.InvoiceCode, body.InvoiceCode)
+	set("qpay_merchant_id", &merchant.QpayMerchantID, body.QpayMerchantID)
+	set("callback_url", &merchant.CallbackURL, body.CallbackURL)
+	set("return_url", &merchant.ReturnURL, body.ReturnURL)
+	if body.Active != nil {
+		merchant.Active = *body.Active
+		columns = append(columns, "active")
+	}
+	if body.Username != "" {
+		if err = merchant.SetCredentials(body.Username, body.Password); err != nil {
+			log.Error().Err(err).Msg("Could not encrypt merchant credentials")
+			return c.JSON(http.StatusInternalServerError, errResponse{
+				Code:    ErrUpdate.Code,
+				Message: err.Error()})
+		}
+		columns = append(columns, "username", "password")
+	}
+	if len(columns) == 0 {
+		return c.JSON(http.StatusOK, response{
+			Message: "Success",
+			Data:    &echo.Map{"merchant": merchant}})
+	}
+
+	if err = merchant.Update(c.Request().Context(), columns...); err != nil {
+		log.Error().Err(err).Msg("Could not update merchant")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"merchant": merchant}})
+}
+
+// RotateWebhookSecret replaces the secret the merchant's webhooks are
+// signed with and returns it once. Deliveries use it from the next attempt.
+func RotateWebhookSecret(c echo.Context) error {
+	merchant, err := readMerchant(c)
+	if err != nil {
+		return merchantError(c, err)
+	}
+
+	secret, err := merchant.NewWebhookSecret()
+	if err == nil {
+		err = merchant.Update(c.Request().Context(), "webhook_secret")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not rotate webhook secret of merchant %v", merchant.ID)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"merchant": merchant, "webhookSecret": secret}})
+}
+
+var errInvalidMerchantID = errors.New("invalid merchant ID")
+
+// readMerchant loads the stored merchant of the :merchantID parameter.
+func readMerchant(c echo.Context) (*models.Merchant, error) {
+	id, err := uuid.Parse(c.Param("merchantID"))
+	if err != nil {
+		return nil, errInvalidMerchantID
+	}
+	if id == models.DefaultMerchantID {
+		return nil, models.ErrMerchantNotFound
+	}
+
+	merchant := models.Merchant{ID: id}
+	if err = merchant.Read(c.Request().Context()); err != nil {
+		return nil, err
+	}
+	return &merchant, nil
+}
+
+func merchantError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errInvalidMerchantID):
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	case errors.Is(err, models.ErrMerchantNotFound):
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+	log.Error().Err(err).Msg("Could not read merchant")
+	return c.JSON(http.StatusInternalServerError, errResponse{
+		Code:    ErrRead.Code,
+		Message: err.Error()})
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"qpay/helpers"
+	"qpay/models"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// payPage is the data of the hosted payment page. Deeplinks use bank app
+// schemes and the QR is a data URI, so both are passed as trusted URLs.
+type payPage struct {
+	InvoiceNumber string
+	Amount        string
+	QrImage       template.URL
+	Banks         []payBank
+	Open          bool
+	Paid          bool
+	ReturnURL     string
+	StatusURL     string
+}
+
+type payBank struct {
+	Name        string
+	Description string
+	Logo        string
+	Link        template.URL
+}
+
+// PayPage renders the public payment page of an invoice, so merchants can
+// send customers a link instead of building their own checkout.
+func PayPage(c echo.Context) error {
+	invoice := models.Invoice{
+		InvoiceID: c.Param("invoiceID"),
+	}
+
+	err := invoice.ReadForInvoiceID(c.Request().Context())
+	if errors.Is(err, models.ErrNotFound) {
+		return c.String(http.StatusNotFound, "Invoice not found")
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.String(http.StatusInternalServerError, "Could not load invoice")
+	}
+
+	page := payPage{
+		InvoiceNumber: invoice.InvoiceNumber,
+		Amount:        invoice.Amount.String(),
+		Open:          invoice.IsOpen(),
+		Paid:          invoice.State == models.Paid,
+		ReturnURL:     invoice.ReturnURL,
+		StatusURL:     "/pay/" + invoice.InvoiceID + "/status",
+	}
+
+	res, err := invoice.QpayResponse()
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not decode stored response of %v", invoice.InvoiceID)
+	} else {
+		if res.QrImage != "" {
+			page.QrImage = template.URL("data:image/png;base64," + res.QrImage)
+		}
+		for _, u := range res.URLs {
+			page.Banks = append(page.Banks, payBank{
+				Name:        u.Name,
+				Description: u.Description,
+				Logo:        u.Logo,
+				Link:        template.URL(u.Link),
+			})
+		}
+	}
+
+	body, err := helpers.RenderTemplate("pay.html", page)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not render payment page")
+		return c.String(http.StatusInternalServerError, "Could not load invoice")
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.HTML(http.StatusOK, body)
+}
+
+// PayStatus is polled by the payment page. It only reads the database, the
+// callback and the poller keep the state current.
+func PayStatus(c echo.Context) error {
+	invoice := models.Invoice{
+		InvoiceID: c.Param("invoiceID"),
+	}
+
+	err := invoice.ReadForInvoiceID(c.Request().Context())
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data: &echo.Map{
+			"state": invoice.State,
+			"open":  invoice.IsOpen(),
+			"paid":  invoice.State == models.Paid,
+		}})
+}
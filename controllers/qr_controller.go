@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"qpay/config"
+	"qpay/helpers"
+	"qpay/models"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	qrDefaultSize   = 300
+	qrMinSize       = 64
+	qrMaxSize       = 2048
+	qrDefaultMargin = 4
+	qrMaxMargin     = 16
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// InvoiceQRPNG renders the stored qr_text of the invoice as a PNG. Accepts
+// size (pixels), margin (modules), level (L, M, Q or H) and logo=true.
+func InvoiceQRPNG(c echo.Context) error {
+	return renderInvoiceQR(c, "png")
+}
+
+// InvoiceQRSVG renders the stored qr_text of the invoice as an SVG.
+func InvoiceQRSVG(c echo.Context) error {
+	return renderInvoiceQR(c, "svg")
+}
+
+func renderInvoiceQR(c echo.Context, format string) error {
+	opts, err := bindQROptions(c, format)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	invoice := models.Invoice{
+		InvoiceID: c.Param("invoiceID"),
+	}
+	err = readInvoice(c, &invoice)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	res, err := invoice.QpayResponse()
+	if err != nil || res.QrText == "" {
+		log.Error().Err(err).Msgf("Could not decode stored response of %v", invoice.InvoiceID)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: "Invoice has no QR text"})
+	}
+
+	// qr_text never changes for a QPay invoice, so the output only depends
+	// on it and the options
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d|%d|%t", res.QrText, format, opts.Size, opts.Margin, opts.Level, opts.Logo)))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, max-age=86400")
+	c.Response().Header().Set("ETag", etag)
+	if match := c.Request().Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	var body []byte
+	var contentType string
+	if format == "svg" {
+		contentType = "image/svg+xml"
+		body, err = helpers.RenderQRSVG(res.QrText, opts)
+	} else {
+		var logo image.Image
+		if opts.Logo {
+			if logo, err = helpers.LoadQRLogo(config.AppConfig.QR.LogoPath); err != nil {
+				log.Error().Err(err).Msg("Could not load QR logo")
+				return c.JSON(http.StatusBadRequest, errResponse{
+					Code:    ErrValidation.Code,
+					Message: "logo is not available"})
+			}
+		}
+		contentType = "image/png"
+		body, err = helpers.RenderQRPNG(res.QrText, opts, logo)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not render QR of %v", invoice.InvoiceID)
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+	return c.Blob(http.StatusOK, contentType, body)
+}
+
+func bindQROptions(c echo.Context, format string) (opts helpers.QROptions, err error) {
+	opts = helpers.QROptions{
+		Size:   qrDefaultSize,
+		Margin: qrDefaultMargin,
+		Level:  qrcode.Medium,
+	}
+
+	if v := c.QueryParam("size"); v != "" {
+		if opts.Size, err = strconv.Atoi(v); err != nil || opts.Size < qrMinSize || opts.Size > qrMaxSize {
+			return opts, fmt.Errorf("size must be between %d and %d", qrMinSize, qrMaxSize)
+		}
+	}
+	if v := c.QueryParam("margin"); v != "" {
+		if opts.Margin, err = strconv.Atoi(v); err != nil || opts.Margin < 0 || opts.Margin > qrMaxMargin {
+			return opts, fmt.Errorf("margin must be between 0 and %d", qrMaxMargin)
+		}
+	}
+	if v := c.QueryParam("level"); v != "" {
+		var ok bool
+		if opts.Level, ok = qrLevels[strings.ToUpper(v)]; !ok {
+			return opts, errors.New("level must be one of L, M, Q, H")
+		}
+	}
+	if c.QueryParam("logo") == "true" {
+		if format != "png" {
+			return opts, errors.New("logo is only supported for png")
+		}
+		opts.Logo = true
+	}
+	return opts, nil
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"qpay/helpers"
+	"qpay/models"
+	"qpay/reconcile"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// GetReconciliation compares QPay's payments of a day (date=2006-01-02,
+// yesterday by default) with the local ones without changing anything. The
+// admin key reconciles the default merchant unless merchantID is given.
+func GetReconciliation(c echo.Context) error {
+	return reconciliation(c, false)
+}
+
+// FixReconciliation reconciles like GetReconciliation and applies the
+// payments missing locally.
+func FixReconciliation(c echo.Context) error {
+	return reconciliation(c, true)
+}
+
+func reconciliation(c echo.Context, autoFix bool) error {
+	date := helpers.Yesterday()
+	if v := c.QueryParam("date"); v != "" {
+		var err error
+		if date, err = time.Parse("2006-01-02", v); err != nil {
+			return c.JSON(http.StatusBadRequest, errResponse{
+				Code:    ErrValidation.Code,
+				Message: "date must be formatted as 2006-01-02"})
+		}
+	}
+
+	merchant, err := reportMerchant(c)
+	if errors.Is(err, models.ErrMerchantNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	report, err := reconcile.Run(c.Request().Context(), merchant, date, autoFix)
+	if errors.Is(err, reconcile.ErrNoMerchant) {
+		return c.JSON(http.StatusServiceUnavailable, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msg("Could not reconcile payments")
+		return c.JSON(http.StatusBadGateway, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"report": report}})
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"qpay/models"
+	q "qpay/qpay"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// RefundBody is the body of POST /api/v1/invoices/:invoiceID/refund. Cancel
+// uses QPay's payment cancel instead of refund, which is only accepted for
+// same-day card payments.
+type RefundBody struct {
+	Reason string `json:"reason"`
+	Cancel bool   `json:"cancel"`
+}
+
+func RefundInvoice(c echo.Context) error {
+	var body RefundBody
+	if err := c.Bind(&body); err != nil {
+		log.Error().Err(err).Msg("Failed to bind request")
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: err.Error(),
+		})
+	}
+	if body.Reason == "" {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: "reason is required",
+		})
+	}
+
+	invoiceIdParam := c.Param("invoiceID")
+	invoice := models.Invoice{
+		InvoiceID: invoiceIdParam,
+	}
+
+	err := readInvoice(c, &invoice)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	// re-read under the invoice lock and reserve the invoice, so concurrent
+	// refunds never both reach QPay; QPay is called once the lock is gone
+	ctx := c.Request().Context()
+	lock := []string{"invoice:" + invoice.MerchantID.String() + ":" + invoice.InvoiceNumber}
+	var r *reply
+	var paymentIDs []string
+	err = models.WithLocks(ctx, lock, func(ctx context.Context) (err error) {
+		if err = invoice.Read(ctx); err != nil {
+			return
+		}
+		if invoice.State == models.Refunded {
+			r = &reply{http.StatusOK, response{
+				Message: "Success",
+				Data:    &echo.Map{"state": invoice.State}}}
+			return
+		}
+		// expired invoices may still hold the payments of a partial payment
+		if invoice.State != models.Paid && invoice.State != models.PartiallyPaid && invoice.State != models.Expired {
+			r = &reply{http.StatusConflict, ErrInvoiceNotPaid}
+			return
+		}
+		if paymentIDs, err = refundablePayments(ctx, &invoice); err != nil {
+			return
+		}
+		if len(paymentIDs) == 0 {
+			r = &reply{http.StatusConflict, ErrInvoiceNotPaid}
+			return
+		}
+		return models.ReserveInvoice(ctx, invoice.MerchantID, invoice.InvoiceNumber, "")
+	})
+	if errors.Is(err, models.ErrLockTimeout) || errors.Is(err, models.ErrInvoiceReserved) {
+		return c.JSON(http.StatusConflict, ErrInvoiceBusy)
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not reserve invoice %v for refund", invoiceIdParam)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+	if r != nil {
+		return c.JSON(r.status, r.body)
+	}
+	defer func() {
+		if err := models.ReleaseInvoice(context.WithoutCancel(ctx), invoice.MerchantID, invoice.InvoiceNumber); err != nil {
+			log.Error().Err(err).Msgf("Could not release invoice %v", invoiceIdParam)
+		}
+	}()
+
+	qpayClient, err := invoice.Client(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not get qpay client: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
+	}
+
+	req := &q.PaymentCancelRequest{Note: body.Reason}
+	var refunded []string
+	for _, paymentID := range paymentIDs {
+		if body.Cancel {
+			err = qpayClient.CancelPayment(paymentID, req)
+		} else {
+			err = qpayClient.RefundPayment(paymentID, req)
+		}
+		if err != nil {
+			break
+		}
+		refunded = append(refunded, paymentID)
+	}
+	if len(refunded) > 0 {
+		if markErr := invoice.MarkRefunded(context.WithoutCancel(ctx), refunded); markErr != nil {
+			log.Error().Err(markErr).Msgf("Could not mark payments %v refunded", refunded)
+			return c.JSON(http.StatusInternalServerError, errResponse{
+				Code:    ErrUpdate.Code,
+				Message: markErr.Error()})
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not refund qpay payments of %v: %v", invoiceIdParam, err.Error())
+		return c.JSON(http.StatusBadGateway, errResponse{
+			Code:    ErrQpay.Code,
+			Message: err.Error()})
+	}
+
+	now := time.Now()
+	err = invoice.Transition(context.WithoutCancel(ctx), models.Transition{
+		To:     models.Refunded,
+		Actor:  requestActor(c),
+		Reason: body.Reason,
+		Values: models.Invoice{RefundReason: body.Reason, RefundedAt: &now},
+	})
+	if errors.Is(err, models.ErrStale) {
+		return c.JSON(http.StatusConflict, ErrStale)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Could not update invoice.")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: "Could not update invoice"})
+	}
+
+	log.Info().Msgf("Invoice refunded: %v, payments: %v", invoiceIdParam, refunded)
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"state": invoice.State, "refundedAt": invoice.RefundedAt}})
+}
+
+// refundablePayments lists the paid payments of the invoice. Invoices paid
+// before payments were stored fall back to the single PaymentID.
+func refundablePayments(ctx context.Context, invoice *models.Invoice) (ids []string, err error) {
+	payments, err := invoice.ListPayments(ctx)
+	if err != nil {
+		return
+	}
+	for _, p := range payments {
+		if p.Status == models.PaymentPaid {
+			ids = append(ids, p.PaymentID)
+		}
+	}
+	if len(payments) == 0 && invoice.PaymentID != "" {
+		ids = append(ids, invoice.PaymentID)
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"qpay/helpers"
+	"qpay/models"
+	"qpay/reports"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// GetSettlementReport returns the settlement report of a day
+// (date=2006-01-02, yesterday by default) as csv (default), xlsx or json.
+// The admin key reports on the default merchant unless merchantID is given.
+func GetSettlementReport(c echo.Context) error {
+	date := helpers.Yesterday()
+	if v := c.QueryParam("date"); v != "" {
+		var err error
+		if date, err = time.Parse("2006-01-02", v); err != nil {
+			return c.JSON(http.StatusBadRequest, errResponse{
+				Code:    ErrValidation.Code,
+				Message: "date must be formatted as 2006-01-02"})
+		}
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" && format != "json" {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: "format must be csv, xlsx or json"})
+	}
+
+	merchant, err := reportMerchant(c)
+	if errors.Is(err, models.ErrMerchantNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	report, err := reports.BuildSettlement(c.Request().Context(), merchant, date)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not build settlement report")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	if format == "json" {
+		return c.JSON(http.StatusOK, response{
+			Message: "Success",
+			Data:    &echo.Map{"report": report}})
+	}
+
+	var buf bytes.Buffer
+	contentType := "text/csv; charset=utf-8"
+	if format == "xlsx" {
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		err = report.WriteXLSX(&buf)
+	} else {
+		err = report.WriteCSV(&buf)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not write settlement report")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+report.Filename(format)+`"`)
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"qpay/models"
+	"qpay/money"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// ListInvoices searches invoices. Dates accept RFC3339 or YYYY-MM-DD in
+// the configured timezone; a date-only upper bound includes that whole day.
+func ListInvoices(c echo.Context) error {
+	filter, err := bindInvoiceFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	invoices, next, err := models.SearchInvoices(c.Request().Context(), filter)
+	if errors.Is(err, models.ErrInvalidCursor) || errors.Is(err, models.ErrUnknownSort) {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msg("Could not search invoices")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"invoices": invoices, "nextCursor": next}})
+}
+
+func bindInvoiceFilter(c echo.Context) (f models.InvoiceFilter, err error) {
+	f = models.InvoiceFilter{
+		InvoiceNumberPrefix: c.QueryParam("invoiceNumber"),
+		ReceiverCode:        c.QueryParam("receiverCode"),
+		IpAddress:           c.QueryParam("ipAddress"),
+		Sort:                c.QueryParam("sort"),
+		Desc:                c.QueryParam("order") != "asc",
+		Limit:               defaultPageSize,
+		Cursor:              c.QueryParam("cursor"),
+	}
+	if f.Sort == "" {
+		f.Sort = "calledAt"
+	}
+	if !models.ValidSort(f.Sort) {
+		return f, fmt.Errorf("unknown sort %q, expected calledAt, paidAt or amount", f.Sort)
+	}
+
+	if f.MerchantID, err = merchantScope(c); err != nil {
+		return
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > maxPageSize {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if v := c.QueryParam("state"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			state := models.QpayState(strings.TrimSpace(s))
+			if !state.Valid() {
+				return f, fmt.Errorf("unknown state %q", state)
+			}
+			f.States = append(f.States, state)
+		}
+	}
+
+	dates := []struct {
+		param string
+		dest  **time.Time
+		upper bool
+	}{
+		{"createdFrom", &f.CreatedFrom, false},
+		{"createdTo", &f.CreatedTo, true},
+		{"paidFrom", &f.PaidFrom, false},
+		{"paidTo", &f.PaidTo, true},
+	}
+	for _, d := range dates {
+		if *d.dest, err = parseTimeParam(c.QueryParam(d.param), d.upper); err != nil {
+			return f, fmt.Errorf("%s: %w", d.param, err)
+		}
+	}
+
+	amounts := []struct {
+		param string
+		dest  **money.Amount
+	}{
+		{"amountMin", &f.AmountMin},
+		{"amountMax", &f.AmountMax},
+	}
+	for _, a := range amounts {
+		if v := c.QueryParam(a.param); v != "" {
+			amount, err := money.Parse(v)
+			if err != nil {
+				return f, fmt.Errorf("%s: %w", a.param, err)
+			}
+			*a.dest = &amount
+		}
+	}
+	return
+}
+
+// parseTimeParam parses an RFC3339 time or a date. Dates used as an
+// exclusive upper bound are moved to the start of the following day.
+func parseTimeParam(v string, upper bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+
+	loc, err := time.LoadLocation(os.Getenv("TIMEZONE"))
+	if err != nil {
+		loc = time.Local
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, loc)
+	if err != nil {
+		return nil, errors.New("expected RFC3339 time or YYYY-MM-DD date")
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"qpay/events"
+	"qpay/models"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// streamHeartbeat keeps proxies from closing idle streams. Every heartbeat
+// also re-reads the invoice, covering changes missed while the listener was
+// reconnecting.
+const streamHeartbeat = 15 * time.Second
+
+// StreamInvoiceEvents pushes the invoice state to the client as Server-Sent
+// Events: the current state first, then every change made by the callback,
+// the poller or any other replica.
+func StreamInvoiceEvents(c echo.Context) error {
+	ctx := c.Request().Context()
+	invoice := models.Invoice{
+		InvoiceID: c.Param("invoiceID"),
+	}
+
+	err := readInvoice(c, &invoice)
+	if errors.Is(err, models.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not read invoice: %v", err.Error())
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	// subscribe before sending the snapshot so no change falls in between
+	changes, unsubscribe := events.Subscribe(invoice.ID)
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	last := invoice.Version
+	if err = writeStateChange(w, invoice.StateChange()); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case change := <-changes:
+			if change.Version <= last {
+				continue
+			}
+			last = change.Version
+			err = writeStateChange(w, change)
+		case <-heartbeat.C:
+			if err = invoice.Read(ctx); err != nil {
+				log.Error().Err(err).Msgf("Could not refresh streamed invoice %v", invoice.InvoiceID)
+				return nil
+			}
+			if invoice.Version > last {
+				last = invoice.Version
+				err = writeStateChange(w, invoice.StateChange())
+			} else {
+				_, err = fmt.Fprint(w, ": ping\n\n")
+				w.Flush()
+			}
+		}
+		if err != nil {
+			// client went away
+			return nil
+		}
+	}
+}
+
+func writeStateChange(w *echo.Response, change models.StateChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "id: %d\nevent: state\ndata: %s\n\n", change.Version, data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"qpay/models"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+func ListWebhooks(c echo.Context) error {
+	status := models.WebhookStatus(c.QueryParam("status"))
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	merchantID, err := merchantScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrValidation.Code,
+			Message: err.Error()})
+	}
+
+	deliveries, err := models.ListWebhookDeliveries(c.Request().Context(), merchantID, status, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list webhook deliveries")
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"deliveries": deliveries}})
+}
+
+func RedeliverWebhook(c echo.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errResponse{
+			Code:    ErrBind.Code,
+			Message: "Invalid webhook ID"})
+	}
+
+	delivery := models.WebhookDelivery{ID: id}
+	err = delivery.Redeliver(c.Request().Context(), merchantScopeOf(c))
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, errResponse{
+			Code:    ErrRead.Code,
+			Message: err.Error()})
+	} else if err != nil {
+		log.Error().Err(err).Msgf("Could not redeliver webhook %v", id)
+		return c.JSON(http.StatusInternalServerError, errResponse{
+			Code:    ErrUpdate.Code,
+			Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, response{
+		Message: "Success",
+		Data:    &echo.Map{"delivery": delivery}})
+}
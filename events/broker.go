@@ -0,0 +1,53 @@
+package events
+
+import (
+	"qpay/models"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// subscriberBuffer is how many changes a slow client may lag behind before
+// further changes are dropped for it. Streams resync from the database on
+// their heartbeat, so a dropped change is only delayed.
+const subscriberBuffer = 8
+
+var (
+	mu          sync.RWMutex
+	subscribers = map[uuid.UUID]map[chan models.StateChange]struct{}{}
+)
+
+// Subscribe returns a channel receiving the state changes of the invoice
+// and a function to stop receiving them.
+func Subscribe(id uuid.UUID) (<-chan models.StateChange, func()) {
+	ch := make(chan models.StateChange, subscriberBuffer)
+
+	mu.Lock()
+	if subscribers[id] == nil {
+		subscribers[id] = map[chan models.StateChange]struct{}{}
+	}
+	subscribers[id][ch] = struct{}{}
+	mu.Unlock()
+
+	return ch, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(subscribers[id], ch)
+		if len(subscribers[id]) == 0 {
+			delete(subscribers, id)
+		}
+	}
+}
+
+// Publish hands a state change to the subscribers of its invoice in this
+// process without blocking.
+func Publish(change models.StateChange) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for ch := range subscribers[change.ID] {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"qpay/config"
+	"qpay/models"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	listenMinBackoff = time.Second
+	listenMaxBackoff = 30 * time.Second
+)
+
+// Listen receives invoice state changes NOTIFYed by any replica and
+// publishes them to local subscribers until ctx is done. It holds its own
+// connection outside the GORM pool and reconnects when it drops.
+func Listen(ctx context.Context) {
+	backoff := listenMinBackoff
+	log.Info().Msgf("🚀 Invoice state listener started, channel: %v", models.InvoiceChannel)
+	for {
+		err := listen(ctx, func() { backoff = listenMinBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Err(err).Msgf("Invoice state listener disconnected, retrying in %v", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > listenMaxBackoff {
+			backoff = listenMaxBackoff
+		}
+	}
+}
+
+func listen(ctx context.Context, connected func()) error {
+	conn, err := pgx.Connect(ctx, config.DatabaseDSN())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{models.InvoiceChannel}.Sanitize()); err != nil {
+		return err
+	}
+	connected()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change models.StateChange
+		if err := json.Unmarshal([]byte(n.Payload), &change); err != nil {
+			log.Error().Err(err).Msgf("Invalid invoice state notification: %v", n.Payload)
+			continue
+		}
+		Publish(change)
+	}
+}
@@ -0,0 +1,86 @@
+package helpers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+var (
+	ErrEncryptionKey = errors.New("MERCHANT_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+	ErrCiphertext    = errors.New("invalid ciphertext")
+)
+
+// encryptionKey reads the AES-256 key secrets at rest are sealed with.
+func encryptionKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("MERCHANT_ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, ErrEncryptionKey
+	}
+	return key, nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	key, err := encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals plaintext with AES-GCM and returns base64(nonce|ciphertext).
+func Encrypt(plaintext string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt.
+func Decrypt(ciphertext string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", ErrCiphertext
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrCiphertext
+	}
+	return string(plaintext), nil
+}
+
+// HashAPIKey returns the hex SHA-256 of an API key, as stored for lookups.
+// Keys are random, so an unsalted hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey returns a random API key with the given prefix.
+func NewAPIKey(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
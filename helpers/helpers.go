@@ -37,3 +37,24 @@ func ConvertDatetimeToTimezone(datetime time.Time) (time.Time, error) {
 
 	return datetime.In(tz), nil
 }
+
+// Day returns the start of date's day and of the next one in the
+// configured timezone. Only the calendar date of date is used.
+func Day(date time.Time) (from, to time.Time, err error) {
+	tz, err := time.LoadLocation(os.Getenv("TIMEZONE"))
+	if err != nil {
+		return
+	}
+	from = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, tz)
+	to = from.AddDate(0, 0, 1)
+	return
+}
+
+// Yesterday is the previous day in the configured timezone.
+func Yesterday() time.Time {
+	now, err := ConvertDatetimeToTimezone(time.Now())
+	if err != nil {
+		now = time.Now()
+	}
+	return now.AddDate(0, 0, -1)
+}
@@ -0,0 +1,64 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Attachment is a file attached to an email.
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// RenderTemplate loads and executes the given template from templates/
+func RenderTemplate(filename string, data any) (string, error) {
+	tmplPath := filepath.Join("templates", filename)
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		return "", fmt.Errorf("template parse error: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("template execute error: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// SendMail sends an HTML email using SMTP
+func SendMail(to []string, subject, body string, attachments ...Attachment) error {
+	username, password, host, port := getSMTPConfig()
+	if username == "" || password == "" || host == "" {
+		return errors.New("missing SMTP credentials")
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", username)
+	m.SetHeader("To", to...)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
+	for _, a := range attachments {
+		data := a.Data
+		m.Attach(a.Name, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}))
+	}
+
+	d := gomail.NewDialer(host, port, username, password)
+	d.SSL = true
+	return d.DialAndSend(m)
+}
+
+// getSMTPConfig reads SMTP credentials from environment
+func getSMTPConfig() (username, password, host string, port int) {
+	return os.Getenv("MAIL_USERNAME"), os.Getenv("MAIL_PASSWORD"), os.Getenv("SMTP_SERVER"), 465
+}
@@ -0,0 +1,173 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/skip2/go-qrcode"
+)
+
+var ErrNoLogo = errors.New("no QR logo configured")
+
+// QROptions control how a QR code is rendered. Size is the image width in
+// pixels (SVG uses it as the viewport), Margin the quiet zone in modules.
+type QROptions struct {
+	Size   int
+	Margin int
+	Level  qrcode.RecoveryLevel
+	Logo   bool
+}
+
+var (
+	logoOnce  sync.Once
+	logoImage image.Image
+	logoErr   error
+)
+
+// LoadQRLogo reads the logo once from path. Later calls return the first
+// result.
+func LoadQRLogo(path string) (image.Image, error) {
+	logoOnce.Do(func() {
+		if path == "" {
+			logoErr = ErrNoLogo
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			logoErr = err
+			return
+		}
+		defer f.Close()
+		logoImage, _, logoErr = image.Decode(f)
+	})
+	return logoImage, logoErr
+}
+
+// qrModules encodes text and returns the module matrix with the quiet zone
+// added. A logo hides the centre of the code, so it needs the highest error
+// correction to stay readable.
+func qrModules(text string, opts QROptions) ([][]bool, error) {
+	level := opts.Level
+	if opts.Logo {
+		level = qrcode.Highest
+	}
+	q, err := qrcode.New(text, level)
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = true
+	bitmap := q.Bitmap()
+
+	n := len(bitmap) + 2*opts.Margin
+	modules := make([][]bool, n)
+	for y := range modules {
+		modules[y] = make([]bool, n)
+		if y < opts.Margin || y >= opts.Margin+len(bitmap) {
+			continue
+		}
+		copy(modules[y][opts.Margin:], bitmap[y-opts.Margin])
+	}
+	return modules, nil
+}
+
+// RenderQRPNG renders text as a PNG of opts.Size pixels, optionally with
+// the logo in the centre.
+func RenderQRPNG(text string, opts QROptions, logo image.Image) ([]byte, error) {
+	modules, err := qrModules(text, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(modules)
+	scale := opts.Size / n
+	if scale < 1 {
+		return nil, fmt.Errorf("size %d is too small for %d modules", opts.Size, n)
+	}
+	// center the code when size is not a multiple of the module count
+	offset := (opts.Size - scale*n) / 2
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Size, opts.Size))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			r := image.Rect(offset+x*scale, offset+y*scale, offset+(x+1)*scale, offset+(y+1)*scale)
+			draw.Draw(img, r, image.Black, image.Point{}, draw.Src)
+		}
+	}
+
+	if opts.Logo && logo != nil {
+		drawLogo(img, logo)
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLogo scales the logo to a fifth of the image, nearest neighbour, on a
+// white pad so it does not blend into the modules around it.
+func drawLogo(img *image.RGBA, logo image.Image) {
+	size := img.Bounds().Dx()
+	side := size / 5
+	pad := side / 10
+	origin := (size - side) / 2
+
+	draw.Draw(img, image.Rect(origin-pad, origin-pad, origin+side+pad, origin+side+pad), image.White, image.Point{}, draw.Src)
+
+	b := logo.Bounds()
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			c := logo.At(b.Min.X+x*b.Dx()/side, b.Min.Y+y*b.Dy()/side)
+			if _, _, _, a := c.RGBA(); a == 0 {
+				continue
+			}
+			img.Set(origin+x, origin+y, color.RGBAModel.Convert(c))
+		}
+	}
+}
+
+// RenderQRSVG renders text as an SVG path, one unit per module, so it
+// scales without loss for print. The logo is not supported.
+func RenderQRSVG(text string, opts QROptions) ([]byte, error) {
+	opts.Logo = false
+	modules, err := qrModules(text, opts)
+	if err != nil {
+		return nil, err
+	}
+	n := len(modules)
+
+	var path strings.Builder
+	for y, row := range modules {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			// join horizontal runs of dark modules into one rectangle
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, opts.Size, opts.Size, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="%s"/></svg>`, n, n, path.String())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,56 @@
+package jobs
+
+import (
+	"context"
+	"qpay/config"
+	"qpay/models"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ebarimtBatchSize = 20
+	ebarimtLease     = 5 * time.Minute
+)
+
+// RunEbarimtWorker issues pending VAT receipts, and voids those of refunded
+// payments, until ctx is done. Receipts are queued automatically when
+// EBARIMT_AUTO is set, or by a manual retry.
+func RunEbarimtWorker(ctx context.Context) {
+	interval := time.Duration(config.AppConfig.Ebarimt.IntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info().Msgf("🚀 Ebarimt worker started, interval: %v, auto: %v", interval, config.AppConfig.Ebarimt.Auto)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			issueDueEbarimts(ctx)
+		}
+	}
+}
+
+func issueDueEbarimts(ctx context.Context) {
+	receipts, err := models.ClaimDueEbarimts(ctx, ebarimtBatchSize, ebarimtLease)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not claim ebarimts")
+		return
+	}
+
+	for n := range receipts {
+		e := &receipts[n]
+		if e.Status == models.EbarimtIssued {
+			if err := e.Void(ctx); err != nil {
+				log.Error().Err(err).Msgf("Could not void ebarimt of refunded payment %v, attempt %v", e.PaymentID, e.Attempts)
+				continue
+			}
+		} else if err := e.Issue(ctx); err != nil {
+			log.Error().Err(err).Msgf("Could not issue ebarimt of payment %v, attempt %v, %v", e.PaymentID, e.Attempts, e.Status)
+			continue
+		}
+		log.Info().Msgf("Ebarimt of payment %v: %v", e.PaymentID, e.Status)
+	}
+}
@@ -0,0 +1,92 @@
+package jobs
+
+import (
+	"context"
+	"qpay/config"
+	"qpay/models"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	expiryBatchSize = 100
+	// expiryLease outlasts the QPay checks of a batch, so no other replica
+	// sweeps the same invoices meanwhile
+	expiryLease = expiryBatchSize*qpayTimeout + time.Minute
+)
+
+// RunExpirySweeper moves open invoices past their expiry to expired. Each
+// invoice gets a last check with QPay first so a late payment is not lost.
+// Partially paid invoices expire too; they are no longer polled and their
+// payments stay refundable.
+func RunExpirySweeper(ctx context.Context) {
+	interval := time.Duration(config.AppConfig.Poller.ExpirySweepSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info().Msgf("🚀 Expiry sweeper started, interval: %v", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweepExpiredInvoices(ctx)
+		}
+	}
+}
+
+func sweepExpiredInvoices(ctx context.Context) {
+	invoices, err := models.ClaimExpiredInvoices(ctx, expiryBatchSize, expiryLease)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list expired invoices")
+		return
+	}
+	if len(invoices) == 0 {
+		return
+	}
+
+	for n := range invoices {
+		invoice := &invoices[n]
+		if err := expireInvoice(ctx, invoice); err != nil {
+			log.Error().Err(err).Msgf("Sweeper could not expire invoice %v", invoice.InvoiceID)
+			// back off so the next batch moves on to other invoices
+			cfg := config.AppConfig.Poller
+			base := time.Duration(cfg.BaseBackoffSeconds) * time.Second
+			max := time.Duration(cfg.MaxBackoffSeconds) * time.Second
+			if err = invoice.SchedulePoll(ctx, base, max); err != nil {
+				log.Error().Err(err).Msgf("Sweeper could not schedule invoice %v", invoice.InvoiceID)
+			}
+		}
+	}
+}
+
+// expireInvoice checks the invoice with QPay a last time and expires it
+// when still not fully paid.
+func expireInvoice(ctx context.Context, invoice *models.Invoice) error {
+	qpayClient, err := invoice.Client(ctx)
+	if err != nil {
+		return err
+	}
+	check, err := qpayClient.CheckInvoice(invoice.InvoiceID)
+	if err != nil {
+		return err
+	}
+	if err = invoice.ApplyPaymentCheck(ctx, check, models.ActorSweeper); err != nil {
+		return err
+	}
+	if invoice.State != models.Unpaid && invoice.State != models.Pending && invoice.State != models.PartiallyPaid {
+		return nil
+	}
+
+	err = invoice.Transition(ctx, models.Transition{
+		To:     models.Expired,
+		Actor:  models.ActorSweeper,
+		Reason: "expiry passed without payment",
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Invoice expired: %v", invoice.InvoiceID)
+	return nil
+}
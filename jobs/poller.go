@@ -0,0 +1,91 @@
+package jobs
+
+import (
+	"context"
+	"qpay/config"
+	"qpay/models"
+	q "qpay/qpay"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// qpayTimeout is the request timeout of the QPay client, the longest one
+// invoice check can take.
+const qpayTimeout = 30 * time.Second
+
+// RunInvoicePoller checks open invoices with QPay in case their callback
+// never reached us. Each invoice backs off exponentially between checks.
+func RunInvoicePoller(ctx context.Context) {
+	cfg := config.AppConfig.Poller
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info().Msgf("🚀 Invoice poller started, interval: %v, concurrency: %v", interval, cfg.Concurrency)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollInvoices(ctx)
+		}
+	}
+}
+
+func pollInvoices(ctx context.Context) {
+	cfg := config.AppConfig.Poller
+	// the lease outlasts a batch whose checks all time out, Concurrency
+	// at a time, so no other replica polls the same invoices meanwhile
+	lease := time.Duration((cfg.BatchSize+cfg.Concurrency-1)/cfg.Concurrency)*qpayTimeout + time.Minute
+	invoices, err := models.ClaimInvoicesToPoll(ctx, cfg.BatchSize, lease)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list invoices to poll")
+		return
+	}
+	if len(invoices) == 0 {
+		return
+	}
+
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for n := range invoices {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(invoice *models.Invoice) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			pollInvoice(ctx, invoice)
+		}(&invoices[n])
+	}
+	wg.Wait()
+}
+
+func pollInvoice(ctx context.Context, invoice *models.Invoice) {
+	cfg := config.AppConfig.Poller
+
+	var check *q.PaymentCheckResponse
+	qpayClient, err := invoice.Client(ctx)
+	if err == nil {
+		check, err = qpayClient.CheckInvoice(invoice.InvoiceID)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Poller could not check invoice %v", invoice.InvoiceID)
+	} else if err = invoice.ApplyPaymentCheck(ctx, check, models.ActorPoller); err != nil {
+		log.Error().Err(err).Msgf("Poller could not update invoice %v", invoice.InvoiceID)
+	}
+
+	if invoice.State == models.Paid {
+		log.Info().Msgf("Poller found invoice paid: %v", invoice.InvoiceID)
+		return
+	}
+
+	base := time.Duration(cfg.BaseBackoffSeconds) * time.Second
+	max := time.Duration(cfg.MaxBackoffSeconds) * time.Second
+	if err = invoice.SchedulePoll(ctx, base, max); err != nil {
+		log.Error().Err(err).Msgf("Poller could not schedule invoice %v", invoice.InvoiceID)
+	}
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"context"
+	"qpay/config"
+	"qpay/helpers"
+	"qpay/models"
+	"qpay/reconcile"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const reconcileRun = "reconcile"
+
+// RunReconciler reconciles the previous day with QPay's payment list each
+// day at RECONCILE_HOUR until ctx is done. Merchants without a QPay
+// merchant ID are skipped.
+func RunReconciler(ctx context.Context) {
+	cfg := config.AppConfig.Reconcile
+
+	log.Info().Msgf("🚀 Reconciler started, hour: %v, auto fix: %v", cfg.Hour, cfg.AutoFix)
+	for {
+		next := nextDailyRun(cfg.Hour)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			reconcileYesterday(ctx)
+		}
+	}
+}
+
+func reconcileYesterday(ctx context.Context) {
+	merchants, err := models.ListActiveMerchants(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list merchants to reconcile")
+		return
+	}
+	date := helpers.Yesterday()
+	for n := range merchants {
+		if merchants[n].QpayMerchantID == "" {
+			continue
+		}
+		reconcileMerchant(ctx, &merchants[n], date)
+	}
+}
+
+func reconcileMerchant(ctx context.Context, merchant *models.Merchant, date time.Time) {
+	period := date.Format("2006-01-02") + "/" + merchant.ID.String()
+
+	// every replica wakes up, only the first one reconciles
+	claimed, err := models.ClaimScheduledRun(ctx, reconcileRun, period)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not claim reconciliation")
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	report, err := reconcile.Run(ctx, merchant, date, config.AppConfig.Reconcile.AutoFix)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not reconcile payments of merchant %v", merchant.Name)
+		if err := models.ReleaseScheduledRun(ctx, reconcileRun, period); err != nil {
+			log.Error().Err(err).Msg("Could not release reconciliation")
+		}
+		return
+	}
+
+	log.Info().Msgf("Reconciled %v of merchant %v: %v", report.Date, merchant.Name, report.Counts)
+	for _, item := range report.Items {
+		if item.Class == reconcile.Matched {
+			continue
+		}
+		log.Warn().Msgf("Reconciliation %v: payment %v, invoice %v, qpay %v, local %v, fixed %v %v, reason %v",
+			item.Class, item.PaymentID, item.InvoiceID, item.QpayAmount, item.LocalAmount, item.Fixed, item.FixError, item.Reason)
+	}
+}
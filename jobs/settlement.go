@@ -0,0 +1,134 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"qpay/config"
+	"qpay/helpers"
+	"qpay/models"
+	"qpay/reports"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	settlementRun        = "settlement-email"
+	settlementRetryEvery = time.Hour
+)
+
+// RunSettlementMailer emails yesterday's settlement report of every active
+// merchant each day at SETTLEMENT_REPORT_HOUR until ctx is done, retrying
+// reports of the last SETTLEMENT_REPORT_DAYS days that could not be sent
+// once an hour. It does nothing without SETTLEMENT_REPORT_EMAILS.
+func RunSettlementMailer(ctx context.Context) {
+	cfg := config.AppConfig.Reports
+	if len(cfg.SettlementEmails) == 0 {
+		log.Info().Msg("⚠️  SETTLEMENT_REPORT_EMAILS not set, settlement emails disabled")
+		return
+	}
+
+	log.Info().Msgf("🚀 Settlement mailer started, hour: %v, to: %v", cfg.SettlementHour, cfg.SettlementEmails)
+	for {
+		next := nextDailyRun(cfg.SettlementHour)
+		if retry := time.Now().Add(settlementRetryEvery); retry.Before(next) {
+			next = retry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			mailSettlement(ctx, cfg.SettlementHour, cfg.SettlementDays, cfg.SettlementEmails)
+		}
+	}
+}
+
+// nextDailyRun is the next time it is hour o'clock in TIMEZONE.
+func nextDailyRun(hour int) time.Time {
+	now, err := helpers.ConvertDatetimeToTimezone(time.Now())
+	if err != nil {
+		now = time.Now()
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func mailSettlement(ctx context.Context, hour, days int, to []string) {
+	merchants, err := models.ListActiveMerchants(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list merchants for settlement emails")
+		return
+	}
+
+	// yesterday's report is due from the hour on, older ones are retries;
+	// reports already sent are skipped by their claim
+	now, err := helpers.ConvertDatetimeToTimezone(time.Now())
+	if err != nil {
+		now = time.Now()
+	}
+	latest := now.AddDate(0, 0, -1)
+	if now.Hour() < hour {
+		latest = latest.AddDate(0, 0, -1)
+	}
+	for n := range merchants {
+		for back := 0; back < days; back++ {
+			date := latest.AddDate(0, 0, -back)
+			// no report for days before the merchant existed
+			if _, end, err := helpers.Day(date); err == nil && end.Before(merchants[n].CreatedAt) {
+				break
+			}
+			mailMerchantSettlement(ctx, &merchants[n], date, to)
+		}
+	}
+}
+
+func mailMerchantSettlement(ctx context.Context, merchant *models.Merchant, date time.Time, to []string) {
+	period := date.Format("2006-01-02") + "/" + merchant.ID.String()
+
+	// every replica wakes up, only the first one sends
+	claimed, err := models.ClaimScheduledRun(ctx, settlementRun, period)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not claim settlement email")
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if err = sendSettlement(ctx, merchant, date, to); err != nil {
+		log.Error().Err(err).Msgf("Could not email settlement report of %v", period)
+		// released so the next wake up retries it
+		if err := models.ReleaseScheduledRun(ctx, settlementRun, period); err != nil {
+			log.Error().Err(err).Msg("Could not release settlement email")
+		}
+		return
+	}
+	log.Info().Msgf("Settlement report of %v sent to %v", period, to)
+}
+
+func sendSettlement(ctx context.Context, merchant *models.Merchant, date time.Time, to []string) error {
+	report, err := reports.BuildSettlement(ctx, merchant, date)
+	if err != nil {
+		return err
+	}
+
+	var csvBuf, xlsxBuf bytes.Buffer
+	if err = report.WriteCSV(&csvBuf); err != nil {
+		return err
+	}
+	if err = report.WriteXLSX(&xlsxBuf); err != nil {
+		return err
+	}
+
+	body, err := helpers.RenderTemplate("settlement.html", report)
+	if err != nil {
+		return err
+	}
+	return helpers.SendMail(to, "Өдрийн тооцооны тайлан "+merchant.Name+" "+report.Date, body,
+		helpers.Attachment{Name: report.Filename("csv"), Data: csvBuf.Bytes()},
+		helpers.Attachment{Name: report.Filename("xlsx"), Data: xlsxBuf.Bytes()},
+	)
+}
@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"qpay/config"
+	"qpay/models"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookBatchSize = 20
+	webhookTimeout   = 15 * time.Second
+	// webhookLease outlasts a batch of deliveries that all time out, so no
+	// other replica claims one still being sent
+	webhookLease       = webhookBatchSize*webhookTimeout + time.Minute
+	webhookBodyLimit   = 2048
+	SignatureHeader    = "X-Webhook-Signature"
+	webhookEventHeader = "X-Webhook-Event"
+	webhookIDHeader    = "X-Webhook-ID"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// RunWebhookWorker delivers queued merchant webhooks until ctx is done.
+func RunWebhookWorker(ctx context.Context) {
+	interval := time.Duration(config.AppConfig.Webhook.IntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info().Msgf("🚀 Webhook worker started, interval: %v", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deliverDueWebhooks(ctx)
+		}
+	}
+}
+
+func deliverDueWebhooks(ctx context.Context) {
+	deliveries, err := models.ClaimDueWebhooks(ctx, webhookBatchSize, webhookLease)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not claim webhook deliveries")
+		return
+	}
+
+	for n := range deliveries {
+		d := &deliveries[n]
+		attempt := deliverWebhook(ctx, d)
+		if err := d.RecordAttempt(ctx, attempt, config.AppConfig.Webhook.MaxAttempts); err != nil {
+			log.Error().Err(err).Msgf("Could not record webhook attempt %v", d.ID)
+			continue
+		}
+		log.Info().Msgf("Webhook %v %v to %v: status %v, attempt %v, %v", d.ID, d.Event, d.URL, d.LastStatusCode, d.Attempts, d.Status)
+	}
+}
+
+func deliverWebhook(ctx context.Context, d *models.WebhookDelivery) (attempt models.WebhookAttempt) {
+	start := time.Now()
+	defer func() {
+		attempt.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	// each merchant has its own secret, so none can sign for another
+	secret, err := d.SigningSecret(ctx)
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookIDHeader, d.ID.String())
+	request.Header.Set(webhookEventHeader, d.Event)
+	request.Header.Set(SignatureHeader, Sign(secret, timestamp, d.Payload))
+
+	resp, err := webhookClient.Do(request)
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookBodyLimit))
+	attempt.StatusCode = resp.StatusCode
+	attempt.ResponseBody = string(body)
+	return
+}
+
+// Sign returns the signature header value for a webhook body. Receivers
+// recompute HMAC-SHA256 over "<t>.<body>" with their merchant's webhook
+// secret and compare it to v1.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
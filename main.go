@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"qpay/config"
+	"qpay/events"
+	"qpay/jobs"
 	"qpay/models"
 	"qpay/routes"
 	"qpay/routes/middlewares"
@@ -27,12 +30,16 @@ func main() {
 	// Connect to the database
 	config.ConnectDatabase()
 
-	err := config.DB.AutoMigrate(&models.Invoice{})
+	err := models.Migrate(config.DB)
 	if err != nil {
-		log.Fatal().Msg("❌ Migration failed:")
+		log.Fatal().Err(err).Msg("❌ Migration failed:")
 	}
 	log.Info().Msg("🚀 Database migrated successfully")
 
+	if err = middlewares.SetupRateLimit(); err != nil {
+		log.Fatal().Err(err).Msg("❌ Invalid rate limit configuration:")
+	}
+
 	// Create Echo instance
 	e := echo.New()
 
@@ -63,6 +70,13 @@ func main() {
 			echo.HeaderAccept,
 			echo.HeaderAuthorization, // <-- Add this
 			"X-API-KEY",
+			"Idempotency-Key",
+		},
+		ExposeHeaders: []string{
+			"RateLimit-Limit",
+			"RateLimit-Remaining",
+			"RateLimit-Reset",
+			"Retry-After",
 		},
 	}))
 
@@ -80,6 +94,24 @@ func main() {
 	// Initialize Invoice routes
 	routes.InvoiceRoute(e)
 	routes.MailRoute(e)
+	routes.WebhookRoute(e)
+	routes.PayRoute(e)
+	routes.PaymentRoute(e)
+	routes.ReconciliationRoute(e)
+	routes.ReportRoute(e)
+	routes.MerchantRoute(e)
+	routes.APIKeyRoute(e)
+
+	// Background workers
+	if config.AppConfig.Webhook.Enabled {
+		go jobs.RunWebhookWorker(context.Background())
+	}
+	go jobs.RunInvoicePoller(context.Background())
+	go jobs.RunExpirySweeper(context.Background())
+	go jobs.RunEbarimtWorker(context.Background())
+	go jobs.RunReconciler(context.Background())
+	go jobs.RunSettlementMailer(context.Background())
+	go events.Listen(context.Background())
 
 	// Start the server
 	log.Info().Msg("🚀 Server starting on :1323")
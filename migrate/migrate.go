@@ -11,7 +11,7 @@ import (
 func main() {
 	config.ConnectDatabase()
 
-	err := config.DB.AutoMigrate(&models.Invoice{})
+	err := models.Migrate(config.DB)
 	if err != nil {
 		log.Fatal("❌ Migration failed:", err)
 	}
@@ -0,0 +1,199 @@
+// models/api_key.go
+
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"qpay/helpers"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+const (
+	ScopeInvoicesCreate Scope = "invoices:create"
+	ScopeInvoicesRead   Scope = "invoices:read"
+	ScopeRefunds        Scope = "refunds"
+	ScopeMailSend       Scope = "mail:send"
+	// ScopeAdmin grants every scope for every merchant
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes lists every known scope.
+var Scopes = []Scope{ScopeInvoicesCreate, ScopeInvoicesRead, ScopeRefunds, ScopeMailSend, ScopeAdmin}
+
+// MerchantScopes are the scopes of a merchant's first key.
+var MerchantScopes = []Scope{ScopeInvoicesCreate, ScopeInvoicesRead, ScopeRefunds, ScopeMailSend}
+
+// HasScope reports whether scopes grant scope. Admin grants every scope.
+func HasScope(scopes []Scope, scope Scope) bool {
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopes checks that every name is a known scope.
+func ParseScopes(names []string) (scopes []Scope, err error) {
+	if len(names) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	for _, name := range names {
+		scope := Scope(strings.TrimSpace(name))
+		if !scope.Valid() {
+			return nil, fmt.Errorf("unknown scope %q", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return
+}
+
+func (s Scope) Valid() bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	apiKeyPrefix = "qk_"
+	// prefixes are shown to tell keys apart, long enough to be distinct
+	// and short enough to reveal nothing useful
+	apiKeyDisplayLength = len(apiKeyPrefix) + 6
+	// last_used_at is written at most this often per key
+	apiKeyTouchInterval = time.Minute
+)
+
+// APIKey authenticates requests by the X-API-KEY header. Only the SHA-256
+// of the key is stored, the key itself is shown once on create and rotate.
+// RatePerMinute and RateBurst override the default rate limit when set.
+type APIKey struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Name          string     `json:"name" gorm:"not null"`
+	MerchantID    uuid.UUID  `json:"merchantID" gorm:"type:uuid;not null;default:'00000000-0000-0000-0000-000000000000';index"`
+	Prefix        string     `json:"prefix" gorm:"type:varchar(16);not null"`
+	KeyHash       string     `json:"-" gorm:"type:varchar(64);uniqueIndex;not null"`
+	Scopes        []Scope    `json:"scopes" gorm:"serializer:json;type:jsonb;not null"`
+	RatePerMinute int        `json:"ratePerMinute,omitempty" gorm:"not null;default:0"`
+	RateBurst     int        `json:"rateBurst,omitempty" gorm:"not null;default:0"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt    *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+func (k *APIKey) Has(scope Scope) bool {
+	return HasScope(k.Scopes, scope)
+}
+
+// Active reports whether the key is neither revoked nor expired.
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now()))
+}
+
+// setKey generates a new key and stores its hash and display prefix.
+func (k *APIKey) setKey() (key string, err error) {
+	if key, err = helpers.NewAPIKey(apiKeyPrefix); err != nil {
+		return
+	}
+	k.KeyHash = helpers.HashAPIKey(key)
+	k.Prefix = key[:apiKeyDisplayLength]
+	return
+}
+
+// Create stores the key and returns its plaintext.
+func (k *APIKey) Create(ctx context.Context) (key string, err error) {
+	if key, err = k.setKey(); err != nil {
+		return
+	}
+	err = dbFrom(ctx).Create(k).Error
+	return
+}
+
+func (k *APIKey) Read(ctx context.Context) (err error) {
+	err = dbFrom(ctx).First(k, "id = ?", k.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrAPIKeyNotFound
+	}
+	return
+}
+
+// ReadForKey loads the active key matching the plaintext key.
+func (k *APIKey) ReadForKey(ctx context.Context, key string) (err error) {
+	err = dbFrom(ctx).
+		Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())").
+		First(k, "key_hash = ?", helpers.HashAPIKey(key)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrAPIKeyNotFound
+	}
+	return
+}
+
+// Touch records that the key was used. Busy keys are written once per
+// apiKeyTouchInterval.
+func (k *APIKey) Touch(ctx context.Context) (err error) {
+	now := time.Now()
+	if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < apiKeyTouchInterval {
+		return
+	}
+	err = dbFrom(ctx).Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", k.ID, now.Add(-apiKeyTouchInterval)).
+		UpdateColumn("last_used_at", now).Error
+	if err == nil {
+		k.LastUsedAt = &now
+	}
+	return
+}
+
+// Rotate replaces the key of an unrevoked API key and returns the new
+// plaintext. The old key stops working immediately.
+func (k *APIKey) Rotate(ctx context.Context) (key string, err error) {
+	if key, err = k.setKey(); err != nil {
+		return
+	}
+	res := dbFrom(ctx).Model(&APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", k.ID).
+		Updates(map[string]interface{}{"key_hash": k.KeyHash, "prefix": k.Prefix, "updated_at": time.Now()})
+	if res.Error != nil {
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		return "", ErrAPIKeyNotFound
+	}
+	return key, k.Read(ctx)
+}
+
+// Revoke disables the key for good. Revoking twice keeps the first time.
+func (k *APIKey) Revoke(ctx context.Context) (err error) {
+	err = dbFrom(ctx).Model(&APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", k.ID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "updated_at": time.Now()}).Error
+	if err != nil {
+		return
+	}
+	return k.Read(ctx)
+}
+
+// ListAPIKeys returns the keys, optionally of one merchant, newest first.
+func ListAPIKeys(ctx context.Context, merchantID *uuid.UUID) (keys []APIKey, err error) {
+	db := dbFrom(ctx).Order("created_at desc")
+	if merchantID != nil {
+		db = db.Where("merchant_id = ?", *merchantID)
+	}
+	err = db.Find(&keys).Error
+	return
+}
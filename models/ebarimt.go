@@ -0,0 +1,332 @@
+// models/ebarimt.go
+
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"qpay/config"
+	"qpay/money"
+	"qpay/qpay"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrEbarimtNotFound = errors.New("ebarimt not found")
+
+type EbarimtStatus string
+
+const (
+	EbarimtPending EbarimtStatus = "pending"
+	// EbarimtIssuing receipts are being created at QPay
+	EbarimtIssuing EbarimtStatus = "issuing"
+	EbarimtIssued  EbarimtStatus = "issued"
+	EbarimtFailed  EbarimtStatus = "failed"
+	// EbarimtCancelled receipts were never issued because their payment
+	// was refunded first
+	EbarimtCancelled EbarimtStatus = "cancelled"
+	// EbarimtVoided receipts were issued and voided at QPay after a refund
+	EbarimtVoided EbarimtStatus = "voided"
+)
+
+const (
+	ebarimtBaseBackoff = time.Minute
+	ebarimtMaxBackoff  = time.Hour
+	// ebarimtIssueLease is how long an issuing receipt is left alone before
+	// the worker takes it up again, after a crash
+	ebarimtIssueLease = 5 * time.Minute
+)
+
+// Ebarimt is the VAT receipt of a payment. Rows are queued as pending and
+// issued at QPay by the ebarimt worker or on request. RefundedAt is set
+// when the payment is refunded; the worker then voids issued receipts.
+type Ebarimt struct {
+	ID            uuid.UUID                `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	PaymentID     string                   `json:"paymentID" gorm:"uniqueIndex;not null"`
+	InvoiceID     uuid.UUID                `json:"-" gorm:"type:uuid;not null;index"`
+	ReceiverType  qpay.EbarimtReceiverType `json:"receiverType" gorm:"type:varchar(20);not null"`
+	Receiver      string                   `json:"receiver,omitempty" gorm:"type:varchar(50)"`
+	Status        EbarimtStatus            `json:"status" gorm:"type:varchar(20);not null;index:idx_ebarimt_due,priority:1"`
+	EbarimtID     string                   `json:"ebarimtID,omitempty"`
+	Amount        money.Amount             `json:"amount"`
+	VatAmount     money.Amount             `json:"vatAmount"`
+	CityTaxAmount money.Amount             `json:"cityTaxAmount"`
+	QrData        string                   `json:"qrData,omitempty" gorm:"type:text"`
+	Lottery       string                   `json:"lottery,omitempty"`
+	Attempts      int                      `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt time.Time                `json:"nextAttemptAt" gorm:"not null;index:idx_ebarimt_due,priority:2"`
+	LastError     string                   `json:"lastError,omitempty" gorm:"type:text"`
+	Raw           []byte                   `json:"-" gorm:"type:jsonb"`
+	IssuedAt      *time.Time               `json:"issuedAt,omitempty"`
+	VoidedAt      *time.Time               `json:"voidedAt,omitempty"`
+	RefundedAt    *time.Time               `json:"refundedAt,omitempty" gorm:"index"`
+	CreatedAt     time.Time                `json:"createdAt"`
+	UpdatedAt     time.Time                `json:"updatedAt"`
+}
+
+// queueEbarimt adds a pending receipt for a paid payment, unless the
+// payment already has one.
+func (i *Invoice) queueEbarimt(tx *gorm.DB, p *Payment) (err error) {
+	e := Ebarimt{
+		PaymentID:     p.PaymentID,
+		InvoiceID:     i.ID,
+		ReceiverType:  i.EbarimtReceiverType,
+		Receiver:      i.EbarimtReceiver,
+		Status:        EbarimtPending,
+		NextAttemptAt: time.Now(),
+	}
+	if e.ReceiverType == "" {
+		e.ReceiverType = qpay.EbarimtCitizen
+	}
+	err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&e).Error
+	return
+}
+
+// ReadForPaymentID loads the receipt of e.PaymentID.
+func (e *Ebarimt) ReadForPaymentID(ctx context.Context) (err error) {
+	err = dbFrom(ctx).First(e, "payment_id = ?", e.PaymentID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrEbarimtNotFound
+	}
+	return
+}
+
+// Request is the QPay request issuing this receipt.
+func (e *Ebarimt) Request() *qpay.EbarimtRequest {
+	return &qpay.EbarimtRequest{
+		PaymentID:           e.PaymentID,
+		EbarimtReceiverType: e.ReceiverType,
+		EbarimtReceiver:     e.Receiver,
+		DistrictCode:        config.AppConfig.Ebarimt.DistrictCode,
+	}
+}
+
+// Retry makes a receipt pending again with the given receiver, for a
+// manual retry. Receipts being issued, issued, cancelled or voided are left
+// untouched.
+func (e *Ebarimt) Retry(ctx context.Context) (err error) {
+	e.Status = EbarimtPending
+	e.Attempts = 0
+	e.NextAttemptAt = time.Now()
+	if e.ReceiverType == "" {
+		e.ReceiverType = qpay.EbarimtCitizen
+	}
+
+	err = dbFrom(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "payment_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"receiver_type", "receiver", "status", "attempts", "next_attempt_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Not(clause.IN{Column: "ebarimts.status", Values: []interface{}{EbarimtIssuing, EbarimtIssued, EbarimtCancelled, EbarimtVoided}}),
+		}},
+	}).Create(e).Error
+	if err != nil {
+		return
+	}
+	return e.ReadForPaymentID(ctx)
+}
+
+// ClaimDueEbarimts locks up to limit receipts that are due, pending ones,
+// ones left issuing by a crash and issued ones of refunded payments, and
+// pushes their next attempt out by lease, so other replicas skip them.
+func ClaimDueEbarimts(ctx context.Context, limit int, lease time.Duration) (receipts []Ebarimt, err error) {
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? OR (status = ? AND refunded_at IS NOT NULL)", []EbarimtStatus{EbarimtPending, EbarimtIssuing}, EbarimtIssued).
+			Where("next_attempt_at <= ?", time.Now()).
+			Order("next_attempt_at asc").
+			Limit(limit).
+			Find(&receipts).Error
+		if err != nil || len(receipts) == 0 {
+			return err
+		}
+
+		ids := make([]uuid.UUID, len(receipts))
+		for n := range receipts {
+			ids[n] = receipts[n].ID
+			// the replica issuing it is gone, so it is issued again
+			if receipts[n].Status == EbarimtIssuing {
+				receipts[n].Status = EbarimtPending
+			}
+		}
+		err = tx.Model(&Ebarimt{}).
+			Where("id IN ? AND status = ?", ids, EbarimtIssuing).
+			Update("status", EbarimtPending).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Ebarimt{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(lease)).Error
+	})
+	return
+}
+
+// RecordResult stores the outcome of a CreateEbarimt call. Failures are
+// retried with exponential backoff until maxAttempts is reached.
+func (e *Ebarimt) RecordResult(ctx context.Context, res *qpay.EbarimtResponse, callErr error, maxAttempts int) (err error) {
+	now := time.Now()
+	e.Attempts++
+
+	switch {
+	case callErr == nil:
+		e.Status = EbarimtIssued
+		e.EbarimtID = res.ID
+		e.Amount = res.Amount
+		e.VatAmount = res.VatAmount
+		e.CityTaxAmount = res.CityTaxAmount
+		e.QrData = res.EbarimtQrData
+		e.Lottery = res.EbarimtLottery
+		e.LastError = ""
+		e.IssuedAt = &now
+		// a refund made meanwhile is voided by the worker right away
+		e.NextAttemptAt = now
+		if e.Raw, err = json.Marshal(res); err != nil {
+			return
+		}
+	case e.Attempts >= maxAttempts:
+		e.Status = EbarimtFailed
+		e.LastError = callErr.Error()
+	default:
+		e.Status = EbarimtPending
+		e.LastError = callErr.Error()
+		e.NextAttemptAt = now.Add(ebarimtBackoff(e.Attempts))
+	}
+
+	err = dbFrom(ctx).Model(e).
+		Select("status", "attempts", "next_attempt_at", "last_error", "ebarimt_id", "amount", "vat_amount", "city_tax_amount", "qr_data", "lottery", "raw", "issued_at").
+		Updates(e).Error
+	return
+}
+
+func ebarimtBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(ebarimtBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if backoff > ebarimtMaxBackoff {
+		backoff = ebarimtMaxBackoff
+	}
+	return backoff
+}
+
+// Issue creates the receipt at QPay and records the outcome. The receipt is
+// first marked issuing under a lock on the payment row, so the worker and a
+// manual retry never issue twice and a refund either comes first and
+// cancels it or marks it to be voided. QPay is called after that commits,
+// with no row locked. The returned error is the QPay one; e holds the
+// recorded state.
+func (e *Ebarimt) Issue(ctx context.Context) (err error) {
+	issue := false
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		var payment Payment
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&payment, "payment_id = ?", e.PaymentID).Error
+		if err != nil {
+			return err
+		}
+		err = tx.First(e, "payment_id = ?", e.PaymentID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrEbarimtNotFound
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case e.Status != EbarimtPending:
+			return nil
+		case payment.Status != PaymentPaid:
+			return e.cancel(tx)
+		}
+
+		issue = true
+		e.Status = EbarimtIssuing
+		e.NextAttemptAt = time.Now().Add(ebarimtIssueLease)
+		return tx.Model(e).Select("status", "next_attempt_at").Updates(e).Error
+	})
+	if err != nil || !issue {
+		return
+	}
+
+	invoice := Invoice{ID: e.InvoiceID}
+	if err = invoice.Read(ctx); err != nil {
+		return
+	}
+	qpayClient, err := invoice.Client(ctx)
+	if err != nil {
+		return
+	}
+	res, callErr := qpayClient.CreateEbarimt(e.Request())
+	if err = e.RecordResult(ctx, res, callErr, config.AppConfig.Ebarimt.MaxAttempts); err != nil {
+		return
+	}
+	return callErr
+}
+
+// Void voids an issued receipt of a refunded payment at QPay. Failures are
+// retried with exponential backoff by the worker.
+func (e *Ebarimt) Void(ctx context.Context) (err error) {
+	if e.Status != EbarimtIssued || e.RefundedAt == nil {
+		return nil
+	}
+
+	invoice := Invoice{ID: e.InvoiceID}
+	if err = invoice.Read(ctx); err != nil {
+		return
+	}
+	qpayClient, err := invoice.Client(ctx)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	callErr := qpayClient.CancelEbarimt(e.PaymentID)
+	if callErr == nil {
+		e.Status = EbarimtVoided
+		e.VoidedAt = &now
+		e.LastError = ""
+	} else {
+		e.Attempts++
+		e.LastError = callErr.Error()
+		e.NextAttemptAt = now.Add(ebarimtBackoff(e.Attempts))
+	}
+	err = dbFrom(ctx).Model(e).
+		Select("status", "voided_at", "attempts", "last_error", "next_attempt_at").
+		Updates(e).Error
+	if err != nil {
+		return
+	}
+	return callErr
+}
+
+// cancel drops an unissued receipt of a payment that is no longer paid.
+func (e *Ebarimt) cancel(tx *gorm.DB) (err error) {
+	e.Status = EbarimtCancelled
+	e.LastError = "payment is no longer paid"
+	err = tx.Model(e).Select("status", "last_error").Updates(e).Error
+	return
+}
+
+// refundEbarimts cancels the unissued receipts of refunded payments and
+// queues the issued ones, and those being issued, to be voided.
+func refundEbarimts(tx *gorm.DB, paymentIDs []string) (err error) {
+	now := time.Now()
+	err = tx.Model(&Ebarimt{}).
+		Where("payment_id IN ? AND status IN ?", paymentIDs, []EbarimtStatus{EbarimtPending, EbarimtFailed}).
+		Updates(map[string]interface{}{"status": EbarimtCancelled, "last_error": "payment refunded", "refunded_at": now, "updated_at": now}).Error
+	if err != nil {
+		return
+	}
+	err = tx.Model(&Ebarimt{}).
+		Where("payment_id IN ? AND status = ? AND refunded_at IS NULL", paymentIDs, EbarimtIssued).
+		Updates(map[string]interface{}{"refunded_at": now, "attempts": 0, "next_attempt_at": now, "updated_at": now}).Error
+	if err != nil {
+		return
+	}
+	// an issuing receipt keeps its lease; once issued it is voided
+	err = tx.Model(&Ebarimt{}).
+		Where("payment_id IN ? AND status = ? AND refunded_at IS NULL", paymentIDs, EbarimtIssuing).
+		Updates(map[string]interface{}{"refunded_at": now, "updated_at": now}).Error
+	return
+}
@@ -0,0 +1,160 @@
+// models/idempotency.go
+
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"qpay/config"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// IdempotencyKey maps a client supplied Idempotency-Key, prefixed with the
+// merchant ID, to the invoice the first request with it returned.
+type IdempotencyKey struct {
+	Key         string    `json:"key" gorm:"type:varchar(300);primaryKey"`
+	Fingerprint string    `json:"fingerprint" gorm:"type:varchar(64);not null"`
+	InvoiceID   uuid.UUID `json:"invoiceRef" gorm:"type:uuid;not null;index"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (k *IdempotencyKey) Read(ctx context.Context) (err error) {
+	err = dbFrom(ctx).First(k, "key = ?", k.Key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrIdempotencyKeyNotFound
+	}
+	return
+}
+
+// Create stores the key. An existing key is left untouched, the first
+// request to use it wins.
+func (k *IdempotencyKey) Create(ctx context.Context) (err error) {
+	err = dbFrom(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(k).Error
+	return
+}
+
+var ErrInvoiceReserved = errors.New("invoice is being changed by a concurrent request")
+
+// reservationTTL outlasts the QPay calls of one create or refund, so a
+// reservation left by a crashed replica frees the invoice number again.
+const reservationTTL = 3 * time.Minute
+
+// InvoiceReservation holds an invoice number, and the idempotency key used
+// with it, while its QPay invoice is created or refunded outside any
+// transaction.
+type InvoiceReservation struct {
+	MerchantID     uuid.UUID `json:"merchantID" gorm:"type:uuid;primaryKey"`
+	InvoiceNumber  string    `json:"invoiceNumber" gorm:"primaryKey"`
+	IdempotencyKey string    `json:"-" gorm:"type:varchar(300);index"`
+	ExpiresAt      time.Time `json:"expiresAt" gorm:"not null"`
+}
+
+// ReserveInvoice reserves the invoice number of the merchant, failing with
+// ErrInvoiceReserved while another request holds it or the idempotency
+// key. Call it under the locks of the number and the key.
+func ReserveInvoice(ctx context.Context, merchantID uuid.UUID, invoiceNumber, idempotencyKey string) (err error) {
+	now := time.Now()
+	q := dbFrom(ctx).Model(&InvoiceReservation{}).
+		Where("expires_at > ?", now).
+		Where("merchant_id = ? AND invoice_number = ?", merchantID, invoiceNumber)
+	if idempotencyKey != "" {
+		q = q.Or("expires_at > ? AND idempotency_key = ?", now, idempotencyKey)
+	}
+	var held int64
+	if err = q.Count(&held).Error; err != nil {
+		return
+	}
+	if held > 0 {
+		return ErrInvoiceReserved
+	}
+
+	err = dbFrom(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&InvoiceReservation{
+		MerchantID:     merchantID,
+		InvoiceNumber:  invoiceNumber,
+		IdempotencyKey: idempotencyKey,
+		ExpiresAt:      now.Add(reservationTTL),
+	}).Error
+	return
+}
+
+// ReleaseInvoice drops the reservation of the invoice number.
+func ReleaseInvoice(ctx context.Context, merchantID uuid.UUID, invoiceNumber string) (err error) {
+	err = dbFrom(ctx).
+		Delete(&InvoiceReservation{}, "merchant_id = ? AND invoice_number = ?", merchantID, invoiceNumber).Error
+	return
+}
+
+var ErrLockTimeout = errors.New("timed out waiting for a concurrent request")
+
+// lockTimeoutCode is the SQLSTATE of a lock_timeout.
+const lockTimeoutCode = "55P03"
+
+type txKey struct{}
+
+// dbFrom returns the transaction of WithLocks when ctx carries one, so
+// queries of the locked section share its connection, or the pool.
+func dbFrom(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx
+	}
+	return config.DB.WithContext(ctx)
+}
+
+// Transaction runs fn in a transaction. Queries fn makes with the ctx it is
+// given commit or roll back together.
+func Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// WithLocks runs fn in a transaction holding Postgres advisory locks on the
+// given keys, so concurrent requests on any replica run one after another.
+// fn must use the ctx it is given: its queries then run on the locked
+// connection and never wait for a second one from the pool.
+//
+// Waiting for the locks is bounded by ctx's deadline and fails with
+// ErrLockTimeout. Once they are held fn runs to the end even if ctx is
+// cancelled, so a section saving QPay results always finishes. The locks are
+// released on commit. Locks are taken in order; callers must always pass
+// keys in the same order. fn must not call QPay: every waiter holds a
+// pooled connection meanwhile.
+func WithLocks(ctx context.Context, keys []string, fn func(ctx context.Context) error) error {
+	detached := context.WithoutCancel(ctx)
+	return config.DB.WithContext(detached).Transaction(func(tx *gorm.DB) error {
+		if deadline, ok := ctx.Deadline(); ok {
+			wait := time.Until(deadline).Milliseconds()
+			if wait <= 0 {
+				return ErrLockTimeout
+			}
+			if err := tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", wait)).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, key := range keys {
+			err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", key).Error
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == lockTimeoutCode {
+				return ErrLockTimeout
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("SET LOCAL lock_timeout = 0").Error; err != nil {
+			return err
+		}
+
+		return fn(context.WithValue(detached, txKey{}, tx))
+	})
+}
@@ -1,6 +1,53 @@
 // models/init.go
 package models
 
-import "qpay/config"
+import (
+	"qpay/config"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
 
 var DB = config.DB
+
+// backfillRun names the ScheduledRun that marks the backfills done.
+const backfillRun = "migration"
+
+// Migrate creates or updates the tables of every model.
+func Migrate(db *gorm.DB) error {
+	// invoice_number became unique per active invoice of a merchant, drop
+	// the old constraints before AutoMigrate adds the partial index
+	if db.Migrator().HasTable(&Invoice{}) {
+		for _, name := range []string{"uni_invoices_invoice_number", "invoices_invoice_number_key"} {
+			if err := db.Exec("ALTER TABLE invoices DROP CONSTRAINT IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := db.AutoMigrate(&Invoice{}, &Payment{}, &WebhookDelivery{}, &WebhookAttempt{}, &InvoiceEvent{}, &IdempotencyKey{}, &Ebarimt{}, &ScheduledRun{}, &Merchant{}, &APIKey{}, &RateLimitBucket{}, &ReconcileFlag{}, &InvoiceReservation{}); err != nil {
+		return err
+	}
+
+	// invoices created before these columns carry the values in their
+	// request. The backfills run once, the claim commits with them.
+	backfills := []string{
+		`UPDATE invoices SET amount = round((request->>'amount')::numeric * 100)
+			WHERE amount = 0 AND request->>'amount' IS NOT NULL`,
+		`UPDATE invoices SET receiver_code = request->>'invoice_receiver_code'
+			WHERE receiver_code IS NULL AND request->>'invoice_receiver_code' IS NOT NULL`,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&ScheduledRun{Name: backfillRun, Period: "backfill"})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		for _, sql := range backfills {
+			if err := tx.Exec(sql).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -4,45 +4,67 @@ package models
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"net/http"
 	"os"
 	"qpay/config"
+	"qpay/money"
+	"qpay/qpay"
 	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var ErrNotFound = errors.New("invoice not found")
-var httpClient = &http.Client{}
+var ErrStale = errors.New("invoice was modified concurrently")
 var validate = validator.New()
 
-
 type QpayState string
 
 const (
-	Unpaid QpayState = "unpaid"
-	Paid   QpayState = "paid"
-	Failed QpayState = "failed"
-	Pending QpayState = "pending"
+	Unpaid        QpayState = "unpaid"
+	Paid          QpayState = "paid"
+	PartiallyPaid QpayState = "partially_paid"
+	Failed        QpayState = "failed"
+	Pending       QpayState = "pending"
+	Cancelled     QpayState = "cancelled"
+	Refunded      QpayState = "refunded"
+	Expired       QpayState = "expired"
 )
 
-
 type Invoice struct {
-	ID            uuid.UUID      `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	IpAddress     string         `json:"ipAddress" gorm:"type:varchar(45);not null"`
-	CalledAt      time.Time      `json:"calledAt" gorm:"not null"`
-	ExpireAt      *time.Time     `json:"expireAt,omitempty"`
-	InvoiceNumber string         `json:"invoiceNumber" gorm:"unique;not null"`
-	Request  	  []byte 		 `json:"-" gorm:"type:jsonb"`
-    Response 	  []byte 		 `json:"-" gorm:"type:jsonb"`
-	InvoiceID     string         `json:"invoiceID" gorm:"unique;not null"`
-	State         QpayState      `json:"state" gorm:"type:varchar(50);not null;default:'unpaid'"`
-	DeletedAt     gorm.DeletedAt `json:"deletedAt" gorm:"index"`
-	CallbackURL   string         `json:"callbackUrl,omitempty" gorm:"type:text"`
-	PaymentID	  string		 `json:"paymentID,omitempty"`
+	ID                  uuid.UUID                `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey;index:idx_invoices_called_at_id,priority:2;index:idx_invoices_paid_at_id,priority:2;index:idx_invoices_amount_id,priority:2"`
+	IpAddress           string                   `json:"ipAddress" gorm:"type:varchar(45);not null;index"`
+	CalledAt            time.Time                `json:"calledAt" gorm:"not null;index:idx_invoices_called_at_id,priority:1;index:idx_invoices_state_called_at,priority:2"`
+	ExpireAt            *time.Time               `json:"expireAt,omitempty"`
+	MerchantID          uuid.UUID                `json:"merchantID" gorm:"type:uuid;not null;default:'00000000-0000-0000-0000-000000000000';uniqueIndex:idx_invoices_merchant_number,priority:1,where:superseded_at IS NULL"`
+	InvoiceNumber       string                   `json:"invoiceNumber" gorm:"not null;uniqueIndex:idx_invoices_merchant_number,priority:2,where:superseded_at IS NULL;index:idx_invoices_number_pattern,expression:invoice_number text_pattern_ops"`
+	ReceiverCode        string                   `json:"receiverCode,omitempty" gorm:"index"`
+	Amount              money.Amount             `json:"amount" gorm:"not null;default:0;index:idx_invoices_amount_id,priority:1"`
+	Currency            string                   `json:"currency" gorm:"type:varchar(3);not null;default:'MNT'"`
+	Fingerprint         string                   `json:"-" gorm:"type:varchar(64)"`
+	Request             []byte                   `json:"-" gorm:"type:jsonb"`
+	Response            []byte                   `json:"-" gorm:"type:jsonb"`
+	InvoiceID           string                   `json:"invoiceID" gorm:"unique;not null"`
+	State               QpayState                `json:"state" gorm:"type:varchar(50);not null;default:'unpaid';index:idx_invoices_state_called_at,priority:1"`
+	Version             int64                    `json:"version" gorm:"not null;default:0"`
+	DeletedAt           gorm.DeletedAt           `json:"deletedAt" gorm:"index"`
+	CallbackURL         string                   `json:"callbackUrl,omitempty" gorm:"type:text"`
+	ReturnURL           string                   `json:"returnUrl,omitempty" gorm:"type:text"`
+	EbarimtReceiverType qpay.EbarimtReceiverType `json:"ebarimtReceiverType,omitempty" gorm:"type:varchar(20)"`
+	EbarimtReceiver     string                   `json:"ebarimtReceiver,omitempty" gorm:"type:varchar(50)"`
+	PaymentID           string                   `json:"paymentID,omitempty"`
+	PaidAt              *time.Time               `json:"paidAt,omitempty" gorm:"index:idx_invoices_paid_at_id,priority:1"`
+	RefundReason        string                   `json:"refundReason,omitempty" gorm:"type:text"`
+	RefundedAt          *time.Time               `json:"refundedAt,omitempty"`
+	Payments            []Payment                `json:"payments,omitempty" gorm:"foreignKey:InvoiceID"`
+	PollAttempts        int                      `json:"-" gorm:"not null;default:0"`
+	NextPollAt          *time.Time               `json:"-" gorm:"index"`
+	PreviousID          *uuid.UUID               `json:"previousID,omitempty" gorm:"type:uuid;index"`
+	SupersededAt        *time.Time               `json:"supersededAt,omitempty"`
 }
 
 func MigrateInvoiceModel() {
@@ -53,37 +75,139 @@ func MigrateInvoiceModel() {
 }
 
 func (i *Invoice) Create(ctx context.Context) (err error) {
-    if err = validate.Struct(i); err != nil {
-        return
-    }
-    err = config.DB.WithContext(ctx).Model(&Invoice{}).Create(i).Error
-    return
+	if err = validate.Struct(i); err != nil {
+		return
+	}
+	err = dbFrom(ctx).Model(&Invoice{}).Create(i).Error
+	return
+}
+
+// CreateReplacing saves the invoice as the reissue of prev. prev is marked
+// superseded in the same transaction so the order keeps one active invoice.
+// An open prev is cancelled by actor.
+func (i *Invoice) CreateReplacing(ctx context.Context, prev *Invoice, actor Actor) (err error) {
+	if err = validate.Struct(i); err != nil {
+		return
+	}
+
+	now := time.Now()
+	i.PreviousID = &prev.ID
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		if prev.State == Unpaid || prev.State == Pending {
+			err := prev.transition(tx, Transition{To: Cancelled, Actor: actor, Reason: "reissued"})
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(prev).Update("superseded_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(i).Error
+	})
+	if err != nil {
+		return
+	}
+	prev.SupersededAt = &now
+	return
+}
+
+// IsExpired reports whether the invoice can no longer be paid because its
+// expiry passed or the sweeper already expired it.
+func (i *Invoice) IsExpired() bool {
+	if i.State == Expired {
+		return true
+	}
+	open := i.State == Unpaid || i.State == Pending || i.State == PartiallyPaid
+	return open && i.ExpireAt != nil && i.ExpireAt.Before(time.Now())
+}
+
+// NeedsReissue reports whether a create request for this invoice number
+// should get a fresh QPay invoice instead of the stored one.
+func (i *Invoice) NeedsReissue() bool {
+	return i.IsExpired() || i.State == Cancelled
+}
+
+// Matches reports whether a create request with the given fingerprint is a
+// replay of the one that created the invoice. Invoices stored before
+// fingerprints only compare the amount.
+func (i *Invoice) Matches(fingerprint string, amount money.Amount) bool {
+	if i.Fingerprint == "" {
+		return i.Amount == amount
+	}
+	return i.Fingerprint == fingerprint
+}
+
+// ClaimExpiredInvoices locks up to limit open invoices whose expiry has
+// passed, skipping those backing off after a failed check, and pushes their
+// next poll out by lease so other replicas skip them while they are swept.
+func ClaimExpiredInvoices(ctx context.Context, limit int, lease time.Duration) (invoices []Invoice, err error) {
+	now := time.Now()
+	return claimInvoices(ctx, limit, lease, func(db *gorm.DB) *gorm.DB {
+		return db.Where("state IN ?", []QpayState{Unpaid, Pending, PartiallyPaid}).
+			Where("expire_at <= ? AND superseded_at IS NULL", now).
+			Where("next_poll_at IS NULL OR next_poll_at <= ?", now).
+			Order("expire_at asc")
+	})
+}
+
+// claimInvoices locks the invoices query selects with SKIP LOCKED and
+// leases them by pushing next_poll_at out.
+func claimInvoices(ctx context.Context, limit int, lease time.Duration, query func(*gorm.DB) *gorm.DB) (invoices []Invoice, err error) {
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		err := query(tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})).
+			Limit(limit).
+			Find(&invoices).Error
+		if err != nil || len(invoices) == 0 {
+			return err
+		}
+
+		next := time.Now().Add(lease)
+		ids := make([]uuid.UUID, len(invoices))
+		for n := range invoices {
+			ids[n] = invoices[n].ID
+			invoices[n].NextPollAt = &next
+		}
+		return tx.Model(&Invoice{}).
+			Where("id IN ?", ids).
+			UpdateColumn("next_poll_at", next).Error
+	})
+	return
 }
 
 func (i *Invoice) Read(ctx context.Context) (err error) {
-	err = config.DB.WithContext(ctx).First(i, "id = ?", i.InvoiceID).Error
+	err = dbFrom(ctx).First(i, "id = ?", i.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
 	return
 }
 
 func (i *Invoice) ReadForInvoiceID(ctx context.Context) (err error) {
-	err = config.DB.WithContext(ctx).First(i, "invoice_id = ?", i.InvoiceID).Error
+	err = dbFrom(ctx).First(i, "invoice_id = ?", i.InvoiceID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
 	return
 }
 
+// ReadForInvoiceNumber reads the current invoice of an order, ignoring
+// invoices that were superseded by a reissue.
 func (i *Invoice) ReadForInvoiceNumber(ctx context.Context) (err error) {
-    err = config.DB.WithContext(ctx).First(i, "invoice_number = ?", i.InvoiceNumber).Error
-    if errors.Is(err, gorm.ErrRecordNotFound) {
-        return ErrNotFound
-    }
-    return
+	err = dbFrom(ctx).First(i, "merchant_id = ? AND invoice_number = ? AND superseded_at IS NULL", i.MerchantID, i.InvoiceNumber).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return
 }
 
+// Update writes non-state columns. State changes go through Transition so
+// they are versioned and recorded.
 func (i *Invoice) Update(ctx context.Context, vals Invoice) (err error) {
 	if err = validate.Struct(vals); err != nil {
 		return
 	}
 
-	err = config.DB.WithContext(ctx).Model(i).Updates(vals).Error
+	err = dbFrom(ctx).Model(i).Omit("state", "version").Updates(vals).Error
 	if err != nil {
 		return
 	}
@@ -97,7 +221,7 @@ func (i *Invoice) UpdateForInvoiceNumber(ctx context.Context, vals Invoice) (err
 		return
 	}
 
-	err = config.DB.WithContext(ctx).Model(i).Updates(vals).Error
+	err = dbFrom(ctx).Model(i).Omit("state", "version").Updates(vals).Error
 	if err != nil {
 		return
 	}
@@ -107,19 +231,60 @@ func (i *Invoice) UpdateForInvoiceNumber(ctx context.Context, vals Invoice) (err
 }
 
 func (i *Invoice) Delete(ctx context.Context) (err error) {
-	err = config.DB.WithContext(ctx).Delete(i).Error
+	err = dbFrom(ctx).Delete(i).Error
 	return
 }
 
-func (i *Invoice) GenerateCallbackURL() string {
-	return os.Getenv("URL") + "/api/v1/invoices/callback/" + i.ID.String()
+// ClaimInvoicesToPoll locks up to limit open, unexpired invoices whose
+// next poll is due and leases them like ClaimExpiredInvoices.
+func ClaimInvoicesToPoll(ctx context.Context, limit int, lease time.Duration) (invoices []Invoice, err error) {
+	now := time.Now()
+	return claimInvoices(ctx, limit, lease, func(db *gorm.DB) *gorm.DB {
+		return db.Where("state IN ?", []QpayState{Unpaid, Pending, PartiallyPaid}).
+			Where("expire_at IS NULL OR expire_at > ?", now).
+			Where("next_poll_at IS NULL OR next_poll_at <= ?", now).
+			Order("next_poll_at asc nulls first")
+	})
 }
 
-func (i *Invoice) CallCallbackURL() {
-	if i.CallbackURL != "" {
-		request, err := http.NewRequest("GET", i.CallbackURL, nil)
-		if err == nil {
-			httpClient.Do(request)
+// SchedulePoll pushes the next poll of the invoice out with exponential
+// backoff, capped at maxBackoff.
+func (i *Invoice) SchedulePoll(ctx context.Context, baseBackoff, maxBackoff time.Duration) (err error) {
+	backoff := maxBackoff
+	if i.PollAttempts < 30 {
+		if b := baseBackoff << i.PollAttempts; b < maxBackoff {
+			backoff = b
 		}
 	}
+	next := time.Now().Add(backoff)
+
+	err = dbFrom(ctx).Model(i).UpdateColumns(map[string]interface{}{
+		"poll_attempts": gorm.Expr("poll_attempts + 1"),
+		"next_poll_at":  next,
+	}).Error
+	if err != nil {
+		return
+	}
+	i.PollAttempts++
+	i.NextPollAt = &next
+	return
+}
+
+// QpayResponse decodes the stored QPay create-invoice reply.
+func (i *Invoice) QpayResponse() (res *qpay.InvoiceResponse, err error) {
+	res = &qpay.InvoiceResponse{}
+	if len(i.Response) == 0 {
+		return
+	}
+	err = json.Unmarshal(i.Response, res)
+	return
+}
+
+// IsOpen reports whether the invoice may still receive payments.
+func (i *Invoice) IsOpen() bool {
+	return (i.State == Unpaid || i.State == Pending || i.State == PartiallyPaid) && !i.IsExpired()
+}
+
+func (i *Invoice) GenerateCallbackURL() string {
+	return os.Getenv("URL") + "/api/v1/invoices/callback/" + i.ID.String()
 }
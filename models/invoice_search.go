@@ -0,0 +1,182 @@
+// models/invoice_search.go
+
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"qpay/money"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+var ErrUnknownSort = errors.New("unknown sort")
+
+// sortColumns maps the public sort keys to their indexed columns. Each is
+// paired with id in a composite index so keyset pages are index scans.
+var sortColumns = map[string]string{
+	"calledAt": "called_at",
+	"paidAt":   "paid_at",
+	"amount":   "amount",
+}
+
+// ValidSort reports whether sort is a public sort key.
+func ValidSort(sort string) bool {
+	_, ok := sortColumns[sort]
+	return ok
+}
+
+// InvoiceFilter narrows an invoice search. Zero fields are ignored.
+type InvoiceFilter struct {
+	MerchantID          *uuid.UUID
+	States              []QpayState
+	InvoiceNumberPrefix string
+	CreatedFrom         *time.Time
+	CreatedTo           *time.Time
+	PaidFrom            *time.Time
+	PaidTo              *time.Time
+	AmountMin           *money.Amount
+	AmountMax           *money.Amount
+	ReceiverCode        string
+	IpAddress           string
+
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+// invoiceCursor is the position after the last row of a page.
+type invoiceCursor struct {
+	CalledAt *time.Time    `json:"c,omitempty"`
+	PaidAt   *time.Time    `json:"p,omitempty"`
+	Amount   *money.Amount `json:"a,omitempty"`
+	ID       uuid.UUID     `json:"id"`
+}
+
+// SearchInvoices returns one page of invoices matching f and the cursor of
+// the next page, empty on the last page.
+func SearchInvoices(ctx context.Context, f InvoiceFilter) (invoices []Invoice, next string, err error) {
+	column, ok := sortColumns[f.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("%w %q", ErrUnknownSort, f.Sort)
+	}
+
+	db := dbFrom(ctx).Model(&Invoice{})
+	if f.MerchantID != nil {
+		db = db.Where("merchant_id = ?", *f.MerchantID)
+	}
+	if len(f.States) > 0 {
+		db = db.Where("state IN ?", f.States)
+	}
+	if f.InvoiceNumberPrefix != "" {
+		db = db.Where("invoice_number LIKE ?", escapeLike(f.InvoiceNumberPrefix)+"%")
+	}
+	if f.CreatedFrom != nil {
+		db = db.Where("called_at >= ?", f.CreatedFrom)
+	}
+	if f.CreatedTo != nil {
+		db = db.Where("called_at < ?", f.CreatedTo)
+	}
+	if f.PaidFrom != nil {
+		db = db.Where("paid_at >= ?", f.PaidFrom)
+	}
+	if f.PaidTo != nil {
+		db = db.Where("paid_at < ?", f.PaidTo)
+	}
+	if f.AmountMin != nil {
+		db = db.Where("amount >= ?", *f.AmountMin)
+	}
+	if f.AmountMax != nil {
+		db = db.Where("amount <= ?", *f.AmountMax)
+	}
+	if f.ReceiverCode != "" {
+		db = db.Where("receiver_code = ?", f.ReceiverCode)
+	}
+	if f.IpAddress != "" {
+		db = db.Where("ip_address = ?", f.IpAddress)
+	}
+	if column == "paid_at" {
+		db = db.Where("paid_at IS NOT NULL")
+	}
+
+	if f.Cursor != "" {
+		value, id, err := decodeInvoiceCursor(f.Cursor, column)
+		if err != nil {
+			return nil, "", err
+		}
+		op := ">"
+		if f.Desc {
+			op = "<"
+		}
+		db = db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, op), value, id)
+	}
+
+	direction := "asc"
+	if f.Desc {
+		direction = "desc"
+	}
+	err = db.Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)).
+		Limit(f.Limit + 1).
+		Find(&invoices).Error
+	if err != nil {
+		return
+	}
+
+	if len(invoices) > f.Limit {
+		invoices = invoices[:f.Limit]
+		next, err = encodeInvoiceCursor(&invoices[len(invoices)-1], column)
+	}
+	return
+}
+
+func encodeInvoiceCursor(i *Invoice, column string) (string, error) {
+	c := invoiceCursor{ID: i.ID}
+	switch column {
+	case "called_at":
+		c.CalledAt = &i.CalledAt
+	case "paid_at":
+		c.PaidAt = i.PaidAt
+	case "amount":
+		c.Amount = &i.Amount
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeInvoiceCursor(s, column string) (value interface{}, id uuid.UUID, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, id, ErrInvalidCursor
+	}
+	var c invoiceCursor
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, id, ErrInvalidCursor
+	}
+
+	switch {
+	case column == "called_at" && c.CalledAt != nil:
+		value = *c.CalledAt
+	case column == "paid_at" && c.PaidAt != nil:
+		value = *c.PaidAt
+	case column == "amount" && c.Amount != nil:
+		value = *c.Amount
+	default:
+		// the cursor belongs to a different sort
+		return nil, id, ErrInvalidCursor
+	}
+	return value, c.ID, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
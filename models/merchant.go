@@ -0,0 +1,164 @@
+// models/merchant.go
+
+package models
+
+import (
+	"context"
+	"errors"
+	"qpay/config"
+	"qpay/helpers"
+	"qpay/qpay"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMerchantNotFound = errors.New("merchant not found")
+	ErrNoWebhookSecret  = errors.New("merchant has no webhook secret, rotate it first")
+)
+
+// webhookSecretPrefix marks webhook secrets so they are easy to spot in
+// secret scanners.
+const webhookSecretPrefix = "whsec_"
+
+// DefaultMerchantID owns invoices of the merchant configured through the
+// QPAY_* environment, including every invoice made before merchants.
+var DefaultMerchantID = uuid.Nil
+
+// Merchant is a shop issuing invoices with its own QPay credentials and
+// webhook secret. Both are encrypted with MERCHANT_ENCRYPTION_KEY.
+type Merchant struct {
+	ID             uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Name           string    `json:"name" gorm:"not null"`
+	Username       string    `json:"-" gorm:"type:text;not null"`
+	Password       string    `json:"-" gorm:"type:text;not null"`
+	WebhookSecret  string    `json:"-" gorm:"type:text"`
+	InvoiceCode    string    `json:"invoiceCode" gorm:"not null"`
+	QpayMerchantID string    `json:"qpayMerchantID,omitempty"`
+	CallbackURL    string    `json:"callbackUrl,omitempty" gorm:"type:text"`
+	ReturnURL      string    `json:"returnUrl,omitempty" gorm:"type:text"`
+	Active         bool      `json:"active" gorm:"not null;default:true"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// DefaultMerchant is the merchant configured through the environment.
+func DefaultMerchant() *Merchant {
+	return &Merchant{
+		ID:             DefaultMerchantID,
+		Name:           "default",
+		InvoiceCode:    config.AppConfig.QPay.InvoiceCode,
+		QpayMerchantID: config.AppConfig.QPay.MerchantID,
+		Active:         true,
+	}
+}
+
+// SetCredentials encrypts the QPay username and password of the merchant.
+func (m *Merchant) SetCredentials(username, password string) (err error) {
+	if m.Username, err = helpers.Encrypt(username); err != nil {
+		return
+	}
+	m.Password, err = helpers.Encrypt(password)
+	return
+}
+
+// NewWebhookSecret replaces the webhook secret of the merchant and returns
+// it, to be shown once. Call Update with "webhook_secret" to store it.
+func (m *Merchant) NewWebhookSecret() (secret string, err error) {
+	if secret, err = helpers.NewAPIKey(webhookSecretPrefix); err != nil {
+		return
+	}
+	m.WebhookSecret, err = helpers.Encrypt(secret)
+	return
+}
+
+// SigningSecret is the secret the merchant's webhooks are signed with. The
+// default merchant uses WEBHOOK_SECRET.
+func (m *Merchant) SigningSecret() (string, error) {
+	if m.ID == DefaultMerchantID {
+		if config.AppConfig.Webhook.Secret == "" {
+			return "", ErrNoWebhookSecret
+		}
+		return config.AppConfig.Webhook.Secret, nil
+	}
+	if m.WebhookSecret == "" {
+		return "", ErrNoWebhookSecret
+	}
+	return helpers.Decrypt(m.WebhookSecret)
+}
+
+// Client returns the QPay client of the merchant from the registry.
+func (m *Merchant) Client() (*qpay.QpayClient, error) {
+	if m.ID == DefaultMerchantID {
+		return qpay.NewClient()
+	}
+
+	username, err := helpers.Decrypt(m.Username)
+	if err != nil {
+		return nil, err
+	}
+	password, err := helpers.Decrypt(m.Password)
+	if err != nil {
+		return nil, err
+	}
+	return qpay.ClientFor(m.ID.String(), qpay.Credentials{
+		Username:    username,
+		Password:    password,
+		InvoiceCode: m.InvoiceCode,
+		MerchantID:  m.QpayMerchantID,
+	}), nil
+}
+
+func (m *Merchant) Create(ctx context.Context) (err error) {
+	err = dbFrom(ctx).Create(m).Error
+	return
+}
+
+// Read loads the merchant by ID. The default merchant is not stored.
+func (m *Merchant) Read(ctx context.Context) (err error) {
+	if m.ID == DefaultMerchantID {
+		*m = *DefaultMerchant()
+		return
+	}
+	err = dbFrom(ctx).First(m, "id = ?", m.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrMerchantNotFound
+	}
+	return
+}
+
+// Update writes the given columns of the merchant.
+func (m *Merchant) Update(ctx context.Context, columns ...string) (err error) {
+	err = dbFrom(ctx).Model(m).Select(columns).Updates(m).Error
+	if err != nil {
+		return
+	}
+	return m.Read(ctx)
+}
+
+// ListMerchants returns every stored merchant by name.
+func ListMerchants(ctx context.Context) (merchants []Merchant, err error) {
+	err = dbFrom(ctx).Order("name asc").Find(&merchants).Error
+	return
+}
+
+// ListActiveMerchants returns the default merchant followed by every active
+// stored one, for jobs that run per merchant.
+func ListActiveMerchants(ctx context.Context) (merchants []Merchant, err error) {
+	err = dbFrom(ctx).Where("active").Order("name asc").Find(&merchants).Error
+	if err != nil {
+		return
+	}
+	return append([]Merchant{*DefaultMerchant()}, merchants...), nil
+}
+
+// Client returns the QPay client of the merchant owning the invoice.
+func (i *Invoice) Client(ctx context.Context) (*qpay.QpayClient, error) {
+	m := Merchant{ID: i.MerchantID}
+	if err := m.Read(ctx); err != nil {
+		return nil, err
+	}
+	return m.Client()
+}
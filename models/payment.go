@@ -0,0 +1,285 @@
+// models/payment.go
+
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"qpay/config"
+	"qpay/money"
+	"qpay/qpay"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type PaymentStatus string
+
+const (
+	PaymentNew      PaymentStatus = "NEW"
+	PaymentFailed   PaymentStatus = "FAILED"
+	PaymentPaid     PaymentStatus = "PAID"
+	PaymentRefunded PaymentStatus = "REFUNDED"
+)
+
+// Payment is a single QPay payment made against an invoice. An invoice can
+// collect several when partial payments are allowed.
+type Payment struct {
+	ID              uuid.UUID     `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	PaymentID       string        `json:"paymentID" gorm:"uniqueIndex;not null"`
+	InvoiceID       uuid.UUID     `json:"-" gorm:"type:uuid;not null;index"`
+	Amount          money.Amount  `json:"amount" gorm:"not null"`
+	Fee             money.Amount  `json:"fee" gorm:"not null;default:0"`
+	Currency        string        `json:"currency" gorm:"type:varchar(3)"`
+	Status          PaymentStatus `json:"status" gorm:"type:varchar(20);not null"`
+	Wallet          string        `json:"wallet,omitempty"`
+	TransactionType string        `json:"transactionType,omitempty"`
+	PaidAt          *time.Time    `json:"paidAt,omitempty"`
+	Raw             []byte        `json:"-" gorm:"type:jsonb"`
+	Ebarimt         *Ebarimt      `json:"ebarimt,omitempty" gorm:"foreignKey:PaymentID;references:PaymentID"`
+	CreatedAt       time.Time     `json:"createdAt"`
+	UpdatedAt       time.Time     `json:"updatedAt"`
+}
+
+func newPaymentFromQpay(invoiceID uuid.UUID, row qpay.Payment) (p Payment, err error) {
+	raw, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+
+	p = Payment{
+		PaymentID:       row.PaymentID,
+		InvoiceID:       invoiceID,
+		Amount:          row.PaymentAmount,
+		Fee:             row.PaymentFee,
+		Currency:        row.PaymentCurrency,
+		Status:          PaymentStatus(row.PaymentStatus),
+		Wallet:          row.PaymentWallet,
+		TransactionType: row.TransactionType,
+		PaidAt:          qpay.ParseTime(row.PaymentDate),
+		Raw:             raw,
+	}
+	if p.Currency == "" {
+		p.Currency = "MNT"
+	}
+	return
+}
+
+// ListPayments returns the payments of the invoice with their receipts,
+// oldest first.
+func (i *Invoice) ListPayments(ctx context.Context) (payments []Payment, err error) {
+	err = dbFrom(ctx).
+		Preload("Ebarimt").
+		Where("invoice_id = ?", i.ID).
+		Order("paid_at asc, created_at asc").
+		Find(&payments).Error
+	return
+}
+
+// PaidTotal sums the payments of the invoice that QPay reports as paid.
+func (i *Invoice) PaidTotal(ctx context.Context) (total money.Amount, err error) {
+	err = dbFrom(ctx).Model(&Payment{}).
+		Where("invoice_id = ? AND status = ?", i.ID, PaymentPaid).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&total).Error
+	return
+}
+
+// ApplyPaymentCheck stores every payment row of a /payment/check reply and
+// derives the invoice state from the paid total versus the invoice amount.
+func (i *Invoice) ApplyPaymentCheck(ctx context.Context, res *qpay.PaymentCheckResponse, actor Actor) (err error) {
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, row := range res.Rows {
+			if row.PaymentID == "" {
+				continue
+			}
+			p, err := newPaymentFromQpay(i.ID, row)
+			if err != nil {
+				return err
+			}
+			err = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "payment_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"amount", "fee", "currency", "status", "wallet", "transaction_type", "paid_at", "raw", "updated_at"}),
+			}).Create(&p).Error
+			if err != nil {
+				return err
+			}
+			if p.Status == PaymentPaid && config.AppConfig.Ebarimt.Auto {
+				if err = i.queueEbarimt(tx, &p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// a concurrent callback or poll may win the transition; re-read and
+	// re-evaluate so side effects fire only for the winner
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			if err = i.Read(ctx); err != nil {
+				return
+			}
+		}
+		err = i.applyPaidTotal(ctx, actor)
+		if errors.Is(err, ErrIllegalTransition) {
+			// the money arrived all the same, so it is kept and left to
+			// reconciliation instead of failing every later check
+			return i.flagPayments(ctx, res, FlagPaymentOnClosedInvoice)
+		}
+		if !errors.Is(err, ErrStale) {
+			return
+		}
+	}
+	return
+}
+
+// flagPayments flags the paid payments of res for reconciliation.
+func (i *Invoice) flagPayments(ctx context.Context, res *qpay.PaymentCheckResponse, reason FlagReason) (err error) {
+	for _, row := range res.Rows {
+		if row.PaymentID == "" || PaymentStatus(row.PaymentStatus) != PaymentPaid {
+			continue
+		}
+		if err = i.Flag(ctx, row.PaymentID, reason); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (i *Invoice) applyPaidTotal(ctx context.Context, actor Actor) (err error) {
+	total, err := i.PaidTotal(ctx)
+	if err != nil {
+		return
+	}
+	state, ok := paidState(total, i.Amount)
+	if !ok {
+		return
+	}
+
+	var latest Payment
+	err = dbFrom(ctx).
+		Where("invoice_id = ? AND status = ?", i.ID, PaymentPaid).
+		Order("paid_at desc nulls last, created_at desc").
+		First(&latest).Error
+	if err != nil {
+		return
+	}
+
+	if state == i.State {
+		if latest.PaymentID != i.PaymentID {
+			err = i.UpdateForInvoiceNumber(ctx, Invoice{PaymentID: latest.PaymentID})
+		}
+		return
+	}
+	err = i.Transition(ctx, Transition{
+		To:     state,
+		Actor:  actor,
+		Reason: fmt.Sprintf("paid %v of %v", total, i.Amount),
+		Values: Invoice{PaymentID: latest.PaymentID, PaidAt: latest.PaidAt},
+	})
+	return
+}
+
+// paidState is the state an invoice of amount is in once total was paid,
+// not ok while nothing was.
+func paidState(total, amount money.Amount) (state QpayState, ok bool) {
+	switch {
+	case total <= 0:
+		return "", false
+	case total >= amount:
+		return Paid, true
+	default:
+		return PartiallyPaid, true
+	}
+}
+
+// HasPayment reports whether QPay listed the payment in a check reply.
+func HasPayment(res *qpay.PaymentCheckResponse, paymentID string) bool {
+	for _, row := range res.Rows {
+		if row.PaymentID == paymentID {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkRefunded flags the given payments as refunded and takes their VAT
+// receipts back.
+func (i *Invoice) MarkRefunded(ctx context.Context, paymentIDs []string) (err error) {
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Payment{}).
+			Where("invoice_id = ? AND payment_id IN ?", i.ID, paymentIDs).
+			Update("status", PaymentRefunded).Error
+		if err != nil {
+			return err
+		}
+		return refundEbarimts(tx, paymentIDs)
+	})
+	return
+}
+
+// ReadForPaymentID loads the payment with the given QPay payment id.
+func (p *Payment) ReadForPaymentID(ctx context.Context) (err error) {
+	err = dbFrom(ctx).First(p, "payment_id = ?", p.PaymentID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return
+}
+
+// InvoicePayment is a payment with the numbers and state of its invoice.
+type InvoicePayment struct {
+	Payment
+	InvoiceNumber     string     `json:"invoiceNumber"`
+	QpayInvoiceID     string     `json:"invoiceID"`
+	InvoiceState      QpayState  `json:"invoiceState"`
+	InvoiceRefundedAt *time.Time `json:"invoiceRefundedAt,omitempty"`
+}
+
+func invoicePayments(ctx context.Context, merchantID uuid.UUID) *gorm.DB {
+	return dbFrom(ctx).Table("payments").
+		Select("payments.*, invoices.invoice_number, invoices.invoice_id AS qpay_invoice_id, invoices.state AS invoice_state, invoices.refunded_at AS invoice_refunded_at").
+		Joins("JOIN invoices ON invoices.id = payments.invoice_id").
+		Where("invoices.merchant_id = ?", merchantID)
+}
+
+// ListPaidPayments returns the payments of the merchant marked paid
+// between from and to.
+// Payments without a payment date count by when they were stored.
+func ListPaidPayments(ctx context.Context, merchantID uuid.UUID, from, to time.Time) (payments []InvoicePayment, err error) {
+	err = invoicePayments(ctx, merchantID).
+		Where("payments.status = ?", PaymentPaid).
+		Where("COALESCE(payments.paid_at, payments.created_at) >= ? AND COALESCE(payments.paid_at, payments.created_at) < ?", from, to).
+		Scan(&payments).Error
+	return
+}
+
+// ListCollectedPayments returns the payments of the merchant collected
+// between from and to, including ones refunded since, oldest first.
+func ListCollectedPayments(ctx context.Context, merchantID uuid.UUID, from, to time.Time) (payments []InvoicePayment, err error) {
+	err = invoicePayments(ctx, merchantID).
+		Where("payments.status IN ?", []PaymentStatus{PaymentPaid, PaymentRefunded}).
+		Where("COALESCE(payments.paid_at, payments.created_at) >= ? AND COALESCE(payments.paid_at, payments.created_at) < ?", from, to).
+		Order("COALESCE(payments.paid_at, payments.created_at) asc").
+		Scan(&payments).Error
+	return
+}
+
+// ListRefundedPayments returns the payments of the merchant whose invoice
+// was refunded between from and to.
+func ListRefundedPayments(ctx context.Context, merchantID uuid.UUID, from, to time.Time) (payments []InvoicePayment, err error) {
+	err = invoicePayments(ctx, merchantID).
+		Where("payments.status = ?", PaymentRefunded).
+		Where("invoices.refunded_at >= ? AND invoices.refunded_at < ?", from, to).
+		Order("invoices.refunded_at asc").
+		Scan(&payments).Error
+	return
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"qpay/money"
+	"qpay/qpay"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPaidState(t *testing.T) {
+	tests := []struct {
+		total, amount money.Amount
+		want          QpayState
+		ok            bool
+	}{
+		{0, 10000, "", false},
+		{-500, 10000, "", false},
+		{1, 10000, PartiallyPaid, true},
+		{9999, 10000, PartiallyPaid, true},
+		{10000, 10000, Paid, true},
+		{10001, 10000, Paid, true},
+	}
+	for _, tt := range tests {
+		got, ok := paidState(tt.total, tt.amount)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("paidState(%v, %v) = %v, %v, want %v, %v", tt.total, tt.amount, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewPaymentFromQpay(t *testing.T) {
+	invoiceID := uuid.New()
+	tests := []struct {
+		name     string
+		row      qpay.Payment
+		currency string
+		paidAt   string
+	}{
+		{
+			name: "paid",
+			row: qpay.Payment{PaymentID: "p1", PaymentStatus: "PAID", PaymentDate: "2024-05-01 10:20:30",
+				PaymentAmount: 150050, PaymentFee: 100, PaymentCurrency: "MNT", PaymentWallet: "khan"},
+			currency: "MNT",
+			paidAt:   "2024-05-01 10:20:30",
+		},
+		{
+			name:     "no currency or date",
+			row:      qpay.Payment{PaymentID: "p2", PaymentStatus: "NEW", PaymentAmount: 500},
+			currency: "MNT",
+		},
+		{
+			name:     "other currency",
+			row:      qpay.Payment{PaymentID: "p3", PaymentStatus: "PAID", PaymentAmount: 500, PaymentCurrency: "USD"},
+			currency: "USD",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPaymentFromQpay(invoiceID, tt.row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.PaymentID != tt.row.PaymentID || p.InvoiceID != invoiceID || p.Amount != tt.row.PaymentAmount ||
+				p.Fee != tt.row.PaymentFee || p.Status != PaymentStatus(tt.row.PaymentStatus) || p.Currency != tt.currency {
+				t.Errorf("newPaymentFromQpay = %+v, want the fields of %+v in %v", p, tt.row, tt.currency)
+			}
+			if tt.paidAt == "" && p.PaidAt != nil {
+				t.Errorf("PaidAt = %v, want nil", p.PaidAt)
+			}
+			if tt.paidAt != "" && (p.PaidAt == nil || p.PaidAt.Format("2006-01-02 15:04:05") != tt.paidAt) {
+				t.Errorf("PaidAt = %v, want %v", p.PaidAt, tt.paidAt)
+			}
+			if len(p.Raw) == 0 {
+				t.Error("Raw is empty, want the QPay row")
+			}
+		})
+	}
+}
+
+func TestHasPayment(t *testing.T) {
+	res := &qpay.PaymentCheckResponse{Count: 2, Rows: []qpay.Payment{{PaymentID: "a"}, {PaymentID: "b"}}}
+	for id, want := range map[string]bool{"a": true, "b": true, "c": false, "": false} {
+		if got := HasPayment(res, id); got != want {
+			t.Errorf("HasPayment(%q) = %v, want %v", id, got, want)
+		}
+	}
+	if HasPayment(&qpay.PaymentCheckResponse{}, "a") {
+		t.Error("HasPayment of an empty reply = true, want false")
+	}
+}
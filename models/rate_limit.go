@@ -0,0 +1,50 @@
+// models/rate_limit.go
+
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimitBucket is a token bucket shared by every replica. Rate is in
+// tokens per second; the row is written on every take.
+type RateLimitBucket struct {
+	Key       string    `json:"key" gorm:"type:varchar(300);primaryKey"`
+	Rate      float64   `json:"rate" gorm:"not null"`
+	Burst     float64   `json:"burst" gorm:"not null"`
+	Tokens    float64   `json:"tokens" gorm:"not null"`
+	Allowed   bool      `json:"allowed" gorm:"not null"`
+	UpdatedAt time.Time `json:"updatedAt" gorm:"not null"`
+}
+
+// TakeRateLimit refills the bucket of key and takes a token when there is
+// one, in one statement so concurrent takes never share a token. A new
+// bucket starts full.
+func TakeRateLimit(ctx context.Context, key string, rate float64, burst int) (b RateLimitBucket, err error) {
+	err = dbFrom(ctx).Raw(`
+		INSERT INTO rate_limit_buckets AS b (key, rate, burst, tokens, allowed, updated_at)
+		VALUES (@key, @rate, @burst, @burst - 1, true, now())
+		ON CONFLICT (key) DO UPDATE SET
+			rate = EXCLUDED.rate,
+			burst = EXCLUDED.burst,
+			tokens = CASE
+				WHEN LEAST(EXCLUDED.burst, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * EXCLUDED.rate) >= 1
+				THEN LEAST(EXCLUDED.burst, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * EXCLUDED.rate) - 1
+				ELSE LEAST(EXCLUDED.burst, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * EXCLUDED.rate)
+			END,
+			allowed = LEAST(EXCLUDED.burst, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * EXCLUDED.rate) >= 1,
+			updated_at = now()
+		RETURNING *`,
+		map[string]interface{}{"key": key, "rate": rate, "burst": burst}).
+		Scan(&b).Error
+	return
+}
+
+// PruneRateLimits deletes buckets that have refilled, dropping them
+// changes nothing.
+func PruneRateLimits(ctx context.Context) (err error) {
+	err = dbFrom(ctx).
+		Exec("DELETE FROM rate_limit_buckets WHERE updated_at + (burst - tokens) / rate * interval '1 second' < now()").Error
+	return
+}
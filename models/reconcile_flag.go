@@ -0,0 +1,70 @@
+// models/reconcile_flag.go
+
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// FlagReason is why an invoice needs a look at reconciliation.
+type FlagReason string
+
+const (
+	// FlagPaymentOnClosedInvoice is a payment QPay reported for an invoice
+	// that can no longer turn paid, e.g. cancelled
+	FlagPaymentOnClosedInvoice FlagReason = "payment_on_closed_invoice"
+	// FlagUnknownPayment is a payment ID a callback named that QPay does
+	// not report for the invoice
+	FlagUnknownPayment FlagReason = "unknown_payment"
+)
+
+// ReconcileFlag marks a payment of an invoice the daily reconciliation
+// must report, whatever QPay's payment list says. Flagging twice keeps the
+// first one.
+type ReconcileFlag struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	MerchantID uuid.UUID  `json:"merchantID" gorm:"type:uuid;not null;index:idx_reconcile_flags_merchant_created,priority:1"`
+	InvoiceID  uuid.UUID  `json:"invoiceID" gorm:"type:uuid;not null;uniqueIndex:idx_reconcile_flags_unique,priority:1"`
+	PaymentID  string     `json:"paymentID" gorm:"not null;uniqueIndex:idx_reconcile_flags_unique,priority:2"`
+	Reason     FlagReason `json:"reason" gorm:"type:varchar(50);not null;uniqueIndex:idx_reconcile_flags_unique,priority:3"`
+	State      QpayState  `json:"state" gorm:"type:varchar(50);not null"`
+	CreatedAt  time.Time  `json:"createdAt" gorm:"index:idx_reconcile_flags_merchant_created,priority:2"`
+}
+
+// Flag records that the payment of the invoice needs reconciling.
+func (i *Invoice) Flag(ctx context.Context, paymentID string, reason FlagReason) (err error) {
+	err = dbFrom(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&ReconcileFlag{
+			MerchantID: i.MerchantID,
+			InvoiceID:  i.ID,
+			PaymentID:  paymentID,
+			Reason:     reason,
+			State:      i.State,
+		}).Error
+	return
+}
+
+// FlaggedPayment is a flag with the numbers of its invoice.
+type FlaggedPayment struct {
+	ReconcileFlag
+	InvoiceNumber string `json:"invoiceNumber"`
+	QpayInvoiceID string `json:"qpayInvoiceID"`
+}
+
+// ListReconcileFlags returns the flags of the merchant raised between from
+// and to, oldest first.
+func ListReconcileFlags(ctx context.Context, merchantID uuid.UUID, from, to time.Time) (flags []FlaggedPayment, err error) {
+	err = dbFrom(ctx).Table("reconcile_flags").
+		Select("reconcile_flags.*, invoices.invoice_number, invoices.invoice_id AS qpay_invoice_id").
+		Joins("JOIN invoices ON invoices.id = reconcile_flags.invoice_id").
+		Where("reconcile_flags.merchant_id = ?", merchantID).
+		Where("reconcile_flags.created_at >= ? AND reconcile_flags.created_at < ?", from, to).
+		Order("reconcile_flags.created_at asc").
+		Scan(&flags).Error
+	return
+}
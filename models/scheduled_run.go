@@ -0,0 +1,34 @@
+// models/scheduled_run.go
+
+package models
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// ScheduledRun marks a scheduled job as done for a period, so only one
+// replica performs it.
+type ScheduledRun struct {
+	Name      string    `json:"name" gorm:"type:varchar(100);primaryKey"`
+	Period    string    `json:"period" gorm:"type:varchar(50);primaryKey"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ClaimScheduledRun records the run and reports whether this caller was
+// the first to claim it.
+func ClaimScheduledRun(ctx context.Context, name, period string) (claimed bool, err error) {
+	res := dbFrom(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&ScheduledRun{Name: name, Period: period})
+	return res.RowsAffected == 1, res.Error
+}
+
+// ReleaseScheduledRun drops a claim so the run can be retried, after it
+// failed.
+func ReleaseScheduledRun(ctx context.Context, name, period string) (err error) {
+	err = dbFrom(ctx).Delete(&ScheduledRun{}, "name = ? AND period = ?", name, period).Error
+	return
+}
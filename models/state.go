@@ -0,0 +1,186 @@
+// models/state.go
+
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrIllegalTransition = errors.New("illegal invoice state transition")
+
+// Actor is who caused an invoice state change.
+type Actor string
+
+const (
+	ActorCallback   Actor = "callback"
+	ActorPoller     Actor = "poller"
+	ActorSweeper    Actor = "sweeper"
+	ActorAPI        Actor = "api"
+	ActorAdmin      Actor = "admin"
+	ActorReconciler Actor = "reconciler"
+)
+
+// transitions lists the states each state may move to. Expired invoices
+// may still turn paid when QPay reports a payment made just before expiry.
+// Partially paid invoices expire too and keep their payments until they
+// are refunded.
+var transitions = map[QpayState][]QpayState{
+	Unpaid:        {Pending, PartiallyPaid, Paid, Expired, Cancelled, Failed},
+	Pending:       {Unpaid, PartiallyPaid, Paid, Expired, Cancelled, Failed},
+	PartiallyPaid: {Paid, Expired, Refunded},
+	Paid:          {Refunded},
+	Expired:       {PartiallyPaid, Paid, Refunded},
+	Cancelled:     {},
+	Refunded:      {},
+	Failed:        {},
+}
+
+// Valid reports whether s is a known invoice state.
+func (s QpayState) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// InvoiceChannel is the Postgres NOTIFY channel state changes are
+// published on, so every replica can push them to its stream clients.
+const InvoiceChannel = "invoice_state"
+
+// StateChange is the NOTIFY payload of a transition.
+type StateChange struct {
+	ID            uuid.UUID `json:"id"`
+	InvoiceID     string    `json:"invoiceID"`
+	InvoiceNumber string    `json:"invoiceNumber"`
+	State         QpayState `json:"state"`
+	Version       int64     `json:"version"`
+	PaymentID     string    `json:"paymentID,omitempty"`
+}
+
+// webhookEvents are the transitions merchants are notified about.
+var webhookEvents = map[QpayState]string{
+	Paid:      "invoice.paid",
+	Cancelled: "invoice.cancelled",
+	Refunded:  "invoice.refunded",
+	Expired:   "invoice.expired",
+}
+
+// CanTransition reports whether an invoice may move from one state to
+// another.
+func CanTransition(from, to QpayState) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// InvoiceEvent records a single state change of an invoice.
+type InvoiceEvent struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	InvoiceID uuid.UUID `json:"-" gorm:"type:uuid;not null;index"`
+	FromState QpayState `json:"fromState" gorm:"type:varchar(50);not null"`
+	ToState   QpayState `json:"toState" gorm:"type:varchar(50);not null"`
+	Actor     Actor     `json:"actor" gorm:"type:varchar(20);not null"`
+	Reason    string    `json:"reason,omitempty" gorm:"type:text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Transition describes a state change. Values holds other columns to write
+// with it; zero fields are ignored.
+type Transition struct {
+	To     QpayState
+	Actor  Actor
+	Reason string
+	Values Invoice
+}
+
+// Transition moves the invoice to a new state, recording the event and
+// queueing the merchant webhook in the same database transaction. The
+// update is a compare-and-swap on Version: if another path changed the
+// invoice since it was read, nothing is written and ErrStale is returned.
+func (i *Invoice) Transition(ctx context.Context, t Transition) (err error) {
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		return i.transition(tx, t)
+	})
+	return
+}
+
+func (i *Invoice) transition(tx *gorm.DB, t Transition) (err error) {
+	from := i.State
+	if !CanTransition(from, t.To) {
+		return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, from, t.To)
+	}
+
+	vals := t.Values
+	vals.State = t.To
+	vals.Version = i.Version + 1
+	if t.To == Paid && vals.PaidAt == nil {
+		now := time.Now()
+		vals.PaidAt = &now
+	}
+	res := tx.Model(&Invoice{}).
+		Where("id = ? AND version = ?", i.ID, i.Version).
+		Updates(vals)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrStale
+	}
+	if err = tx.First(i, "id = ?", i.ID).Error; err != nil {
+		return
+	}
+
+	err = tx.Create(&InvoiceEvent{
+		InvoiceID: i.ID,
+		FromState: from,
+		ToState:   t.To,
+		Actor:     t.Actor,
+		Reason:    t.Reason,
+	}).Error
+	if err != nil {
+		return
+	}
+
+	if event, ok := webhookEvents[t.To]; ok {
+		if err = i.enqueueWebhook(tx, event); err != nil {
+			return
+		}
+	}
+
+	// delivered by Postgres on commit only
+	payload, err := json.Marshal(i.StateChange())
+	if err != nil {
+		return
+	}
+	err = tx.Exec("SELECT pg_notify(?, ?)", InvoiceChannel, string(payload)).Error
+	return
+}
+
+// StateChange describes the current state of the invoice.
+func (i *Invoice) StateChange() StateChange {
+	return StateChange{
+		ID:            i.ID,
+		InvoiceID:     i.InvoiceID,
+		InvoiceNumber: i.InvoiceNumber,
+		State:         i.State,
+		Version:       i.Version,
+		PaymentID:     i.PaymentID,
+	}
+}
+
+// ListEvents returns the state history of the invoice, oldest first.
+func (i *Invoice) ListEvents(ctx context.Context) (events []InvoiceEvent, err error) {
+	err = dbFrom(ctx).
+		Where("invoice_id = ?", i.ID).
+		Order("created_at asc").
+		Find(&events).Error
+	return
+}
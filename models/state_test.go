@@ -0,0 +1,45 @@
+package models
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	states := []QpayState{Unpaid, Pending, PartiallyPaid, Paid, Expired, Cancelled, Refunded, Failed}
+	allowed := map[QpayState]map[QpayState]bool{
+		Unpaid:        {Pending: true, PartiallyPaid: true, Paid: true, Expired: true, Cancelled: true, Failed: true},
+		Pending:       {Unpaid: true, PartiallyPaid: true, Paid: true, Expired: true, Cancelled: true, Failed: true},
+		PartiallyPaid: {Paid: true, Expired: true, Refunded: true},
+		Paid:          {Refunded: true},
+		Expired:       {PartiallyPaid: true, Paid: true, Refunded: true},
+	}
+
+	for _, from := range states {
+		for _, to := range states {
+			want := allowed[from][to]
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%v, %v) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestCanTransitionUnknownState(t *testing.T) {
+	if CanTransition("unknown", Paid) {
+		t.Error("CanTransition from an unknown state must be false")
+	}
+	if CanTransition(Unpaid, "unknown") {
+		t.Error("CanTransition to an unknown state must be false")
+	}
+}
+
+func TestQpayStateValid(t *testing.T) {
+	for _, s := range []QpayState{Unpaid, Pending, PartiallyPaid, Paid, Expired, Cancelled, Refunded, Failed} {
+		if !s.Valid() {
+			t.Errorf("%v.Valid() = false, want true", s)
+		}
+	}
+	for _, s := range []QpayState{"", "PAID", "unknown"} {
+		if s.Valid() {
+			t.Errorf("%q.Valid() = true, want false", s)
+		}
+	}
+}
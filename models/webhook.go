@@ -0,0 +1,227 @@
+// models/webhook.go
+
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"qpay/config"
+	"qpay/money"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrWebhookNotFound = errors.New("webhook delivery not found")
+
+type WebhookStatus string
+
+const (
+	WebhookPending   WebhookStatus = "pending"
+	WebhookDelivered WebhookStatus = "delivered"
+	WebhookFailed    WebhookStatus = "failed"
+)
+
+const (
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+// WebhookEvent is the JSON body POSTed to the merchant CallbackURL.
+type WebhookEvent struct {
+	ID            uuid.UUID    `json:"id"`
+	Event         string       `json:"event"`
+	InvoiceID     string       `json:"invoiceID"`
+	InvoiceNumber string       `json:"invoiceNumber"`
+	State         QpayState    `json:"state"`
+	PaymentID     string       `json:"paymentID,omitempty"`
+	Amount        money.Amount `json:"amount"`
+	OccurredAt    time.Time    `json:"occurredAt"`
+}
+
+// WebhookDelivery is an outbox row for one event to one merchant URL. It is
+// retried with exponential backoff until delivered or out of attempts.
+type WebhookDelivery struct {
+	ID             uuid.UUID        `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	InvoiceID      uuid.UUID        `json:"invoiceRef" gorm:"type:uuid;not null;index"`
+	Event          string           `json:"event" gorm:"type:varchar(50);not null"`
+	URL            string           `json:"url" gorm:"type:text;not null"`
+	Payload        []byte           `json:"-" gorm:"type:jsonb;not null"`
+	Status         WebhookStatus    `json:"status" gorm:"type:varchar(20);not null;index:idx_webhook_due,priority:1"`
+	Attempts       int              `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt  time.Time        `json:"nextAttemptAt" gorm:"not null;index:idx_webhook_due,priority:2"`
+	LastStatusCode int              `json:"lastStatusCode,omitempty"`
+	LastError      string           `json:"lastError,omitempty" gorm:"type:text"`
+	DeliveredAt    *time.Time       `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	UpdatedAt      time.Time        `json:"updatedAt"`
+	Log            []WebhookAttempt `json:"log,omitempty" gorm:"foreignKey:DeliveryID"`
+}
+
+// WebhookAttempt records the outcome of a single delivery attempt.
+type WebhookAttempt struct {
+	ID           uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	DeliveryID   uuid.UUID `json:"-" gorm:"type:uuid;not null;index"`
+	StatusCode   int       `json:"statusCode"`
+	Error        string    `json:"error,omitempty" gorm:"type:text"`
+	ResponseBody string    `json:"responseBody,omitempty" gorm:"type:text"`
+	DurationMs   int64     `json:"durationMs"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// enqueueWebhook stores a delivery of the given event for the merchant
+// CallbackURL. Invoices without a CallbackURL are skipped, and every
+// invoice while webhooks are disabled.
+func (i *Invoice) enqueueWebhook(tx *gorm.DB, event string) (err error) {
+	if i.CallbackURL == "" || !config.AppConfig.Webhook.Enabled {
+		return
+	}
+
+	d := WebhookDelivery{
+		ID:            uuid.New(),
+		InvoiceID:     i.ID,
+		Event:         event,
+		URL:           i.CallbackURL,
+		Status:        WebhookPending,
+		NextAttemptAt: time.Now(),
+	}
+	d.Payload, err = json.Marshal(WebhookEvent{
+		ID:            d.ID,
+		Event:         event,
+		InvoiceID:     i.InvoiceID,
+		InvoiceNumber: i.InvoiceNumber,
+		State:         i.State,
+		PaymentID:     i.PaymentID,
+		Amount:        i.Amount,
+		OccurredAt:    d.NextAttemptAt,
+	})
+	if err != nil {
+		return
+	}
+
+	err = tx.Create(&d).Error
+	return
+}
+
+// ClaimDueWebhooks locks up to limit pending deliveries that are due and
+// pushes their next attempt out by lease, so other replicas skip them while
+// they are being sent.
+func ClaimDueWebhooks(ctx context.Context, limit int, lease time.Duration) (deliveries []WebhookDelivery, err error) {
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", WebhookPending, time.Now()).
+			Order("next_attempt_at asc").
+			Limit(limit).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]uuid.UUID, len(deliveries))
+		for n, d := range deliveries {
+			ids[n] = d.ID
+		}
+		return tx.Model(&WebhookDelivery{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(lease)).Error
+	})
+	return
+}
+
+// RecordAttempt logs an attempt and schedules the next one, marking the
+// delivery failed once maxAttempts is reached.
+func (d *WebhookDelivery) RecordAttempt(ctx context.Context, attempt WebhookAttempt, maxAttempts int) (err error) {
+	now := time.Now()
+	d.Attempts++
+	d.LastStatusCode = attempt.StatusCode
+	d.LastError = attempt.Error
+
+	switch {
+	case attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300:
+		d.Status = WebhookDelivered
+		d.DeliveredAt = &now
+	case d.Attempts >= maxAttempts:
+		d.Status = WebhookFailed
+	default:
+		backoff := time.Duration(float64(webhookBaseBackoff) * math.Pow(2, float64(d.Attempts-1)))
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttemptAt = now.Add(backoff)
+	}
+
+	attempt.DeliveryID = d.ID
+	err = dbFrom(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+		return tx.Model(d).Select("status", "attempts", "next_attempt_at", "last_status_code", "last_error", "delivered_at").Updates(d).Error
+	})
+	return
+}
+
+// ListWebhookDeliveries returns the newest deliveries, optionally filtered
+// by merchant and status, with their attempt log.
+func ListWebhookDeliveries(ctx context.Context, merchantID *uuid.UUID, status WebhookStatus, limit int) (deliveries []WebhookDelivery, err error) {
+	db := dbFrom(ctx).Preload("Log", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at asc")
+	})
+	if merchantID != nil {
+		db = db.Where("invoice_id IN (?)", config.DB.Model(&Invoice{}).Select("id").Where("merchant_id = ?", *merchantID))
+	}
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	err = db.Order("created_at desc").Limit(limit).Find(&deliveries).Error
+	return
+}
+
+// ListWebhookDeliveries returns the deliveries queued for the invoice,
+// newest first, without their attempt log.
+func (i *Invoice) ListWebhookDeliveries(ctx context.Context) (deliveries []WebhookDelivery, err error) {
+	err = dbFrom(ctx).
+		Where("invoice_id = ?", i.ID).
+		Order("created_at desc").
+		Find(&deliveries).Error
+	return
+}
+
+// Redeliver resets a delivery so the worker sends it again immediately.
+// With a merchantID, deliveries of other merchants are not found.
+func (d *WebhookDelivery) Redeliver(ctx context.Context, merchantID *uuid.UUID) (err error) {
+	db := dbFrom(ctx)
+	if merchantID != nil {
+		db = db.Where("invoice_id IN (?)", config.DB.Model(&Invoice{}).Select("id").Where("merchant_id = ?", *merchantID))
+	}
+	err = db.First(d, "id = ?", d.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrWebhookNotFound
+	} else if err != nil {
+		return
+	}
+
+	d.Status = WebhookPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	err = dbFrom(ctx).Model(d).Select("status", "attempts", "next_attempt_at").Updates(d).Error
+	return
+}
+
+// SigningSecret is the webhook secret of the merchant owning the invoice
+// of the delivery.
+func (d *WebhookDelivery) SigningSecret(ctx context.Context) (string, error) {
+	var invoice Invoice
+	err := dbFrom(ctx).Select("merchant_id").First(&invoice, "id = ?", d.InvoiceID).Error
+	if err != nil {
+		return "", err
+	}
+	m := Merchant{ID: invoice.MerchantID}
+	if err = m.Read(ctx); err != nil {
+		return "", err
+	}
+	return m.SigningSecret()
+}
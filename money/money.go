@@ -0,0 +1,142 @@
+package money
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MNT is the only currency QPay invoices are issued in.
+const MNT = "MNT"
+
+// Scale is the number of minor units in one tögrög.
+const Scale = 100
+
+var (
+	ErrSyntax    = errors.New("invalid amount")
+	ErrPrecision = errors.New("amount has more than 2 decimal places")
+	ErrRange     = errors.New("amount out of range")
+)
+
+// Amount is a sum of money in minor units (1/100 tögrög). It is stored as a
+// bigint and written to JSON as a decimal number, so totals are added and
+// compared exactly.
+type Amount int64
+
+// FromTogrog returns the amount of whole tögrög.
+func FromTogrog(t int64) Amount {
+	return Amount(t * Scale)
+}
+
+// FromFloat converts a float from an external payload, rounding to the
+// nearest minor unit.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * Scale))
+}
+
+// Parse reads a decimal string such as "1500", "1500.5" or "-20.25".
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || strings.Trim(whole, "0123456789") != "" || strings.Trim(frac, "0123456789") != "" {
+		return 0, fmt.Errorf("%w: %q", ErrSyntax, s)
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("%w: %q", ErrPrecision, s)
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || w > math.MaxInt64/Scale-1 {
+		return 0, fmt.Errorf("%w: %q", ErrRange, s)
+	}
+	f, _ := strconv.ParseInt(frac, 10, 64)
+
+	a := Amount(w*Scale + f)
+	if neg {
+		a = -a
+	}
+	return a, nil
+}
+
+// Togrog returns the whole tögrög part of the amount.
+func (a Amount) Togrog() int64 {
+	return int64(a) / Scale
+}
+
+// Float returns the amount in tögrög for display. Never compare floats.
+func (a Amount) Float() float64 {
+	return float64(a) / Scale
+}
+
+// String formats the amount in tögrög, with decimals only when needed.
+func (a Amount) String() string {
+	sign := ""
+	v := int64(a)
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	if v%Scale == 0 {
+		return fmt.Sprintf("%s%d", sign, v/Scale)
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/Scale, v%Scale)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts both JSON numbers and numeric strings, as QPay uses
+// either depending on the endpoint.
+func (a *Amount) UnmarshalJSON(b []byte) (err error) {
+	b = bytes.TrimSpace(b)
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 1 && b[0] == '"' {
+		var s string
+		if s, err = strconv.Unquote(string(b)); err != nil {
+			return fmt.Errorf("%w: %s", ErrSyntax, b)
+		}
+		if s == "" {
+			*a = 0
+			return nil
+		}
+		b = []byte(s)
+	}
+
+	// exponents only come from float encoders, fall back to rounding
+	if bytes.ContainsAny(b, "eE") {
+		f, err := strconv.ParseFloat(string(b), 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrSyntax, b)
+		}
+		if math.Abs(f) >= math.MaxInt64/Scale {
+			return fmt.Errorf("%w: %s", ErrRange, b)
+		}
+		*a = FromFloat(f)
+		return nil
+	}
+
+	*a, err = Parse(string(b))
+	return
+}
+
+// Validate checks that the amount is positive and does not exceed max. A
+// zero max disables the upper bound.
+func (a Amount) Validate(max Amount) error {
+	if a <= 0 {
+		return fmt.Errorf("%w: must be positive", ErrRange)
+	}
+	if max > 0 && a > max {
+		return fmt.Errorf("%w: must not exceed %v", ErrRange, max)
+	}
+	return nil
+}
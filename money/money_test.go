@@ -0,0 +1,114 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		err  error
+	}{
+		{"1500", 150000, nil},
+		{"1500.5", 150050, nil},
+		{"1500.50", 150050, nil},
+		{"1500.500", 150050, nil},
+		{"-20.25", -2025, nil},
+		{"0.01", 1, nil},
+		{" 7 ", 700, nil},
+		{"007", 700, nil},
+		{"92233720368547757.99", 9223372036854775799, nil},
+		{"1.005", 0, ErrPrecision},
+		{"0.001", 0, ErrPrecision},
+		{"92233720368547758", 0, ErrRange},
+		{"99999999999999999999", 0, ErrRange},
+		{"", 0, ErrSyntax},
+		{"-", 0, ErrSyntax},
+		{".5", 0, ErrSyntax},
+		{"+5", 0, ErrSyntax},
+		{"1,5", 0, ErrSyntax},
+		{"1.2.3", 0, ErrSyntax},
+		{"1e3", 0, ErrSyntax},
+		{"abc", 0, ErrSyntax},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		err  error
+	}{
+		{`1500`, 150000, nil},
+		{`1500.25`, 150025, nil},
+		{`"1500.25"`, 150025, nil},
+		{`-3.5`, -350, nil},
+		{`""`, 0, nil},
+		{`1.5e3`, 150000, nil},
+		{`"1E2"`, 10000, nil},
+		{`1.0051e0`, 101, nil},
+		{`2.5E-1`, 25, nil},
+		{`1.005`, 0, ErrPrecision},
+		{`92233720368547758`, 0, ErrRange},
+		{`1e17`, 0, ErrRange},
+		{`-1e17`, 0, ErrRange},
+		{`1e400`, 0, ErrSyntax},
+		{`"abc"`, 0, ErrSyntax},
+		{`"1500`, 0, ErrSyntax},
+		{`true`, 0, ErrSyntax},
+	}
+	for _, tt := range tests {
+		var got Amount
+		err := got.UnmarshalJSON([]byte(tt.in))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("UnmarshalJSON(%s) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalJSONNull(t *testing.T) {
+	a := Amount(700)
+	if err := json.Unmarshal([]byte(`null`), &a); err != nil || a != 700 {
+		t.Errorf("Unmarshal(null) = %d, %v, want 700 unchanged", a, err)
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0"},
+		{150000, "1500"},
+		{150050, "1500.50"},
+		{1, "0.01"},
+		{-2025, "-20.25"},
+		{-5, "-0.05"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", tt.in, got, tt.want)
+		}
+		back, err := Parse(tt.want)
+		if err != nil || back != tt.in {
+			t.Errorf("Parse(%q) = %d, %v, want %d", tt.want, back, err, tt.in)
+		}
+	}
+}
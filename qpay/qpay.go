@@ -3,113 +3,140 @@ package qpay
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
 type QpayClient struct {
-	username          string
-	password          string
-	invoiceCode       string
-	AccessToken       string `json:"access_token"`
-	AccessTokenExpire int64  `json:"expires_in"`
-	httpClient        *http.Client
+	username    string
+	password    string
+	invoiceCode string
+	merchantID  string
+	tokens      tokenManager
+	httpClient  *http.Client
 }
 
-var Client *QpayClient
+// Credentials are what a client logs in and issues invoices with.
+type Credentials struct {
+	Username    string
+	Password    string
+	InvoiceCode string
+	MerchantID  string
+}
+
+var (
+	Client   *QpayClient
+	clientMu sync.Mutex
 
+	// clients holds one client per merchant, each with its own token cache
+	clients = map[string]*QpayClient{}
+)
+
+// NewClient returns the client of the default merchant configured by
+// QPAY_USERNAME, QPAY_PASSWORD and QPAY_INVOICE_CODE.
 func NewClient() (c *QpayClient, err error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
 	if Client != nil {
 		c = Client
 		return
 	}
 
-	c = &QpayClient{
-		username:    os.Getenv("QPAY_USERNAME"),
-		password:    os.Getenv("QPAY_PASSWORD"),
-		invoiceCode: os.Getenv("QPAY_INVOICE_CODE"),
-		httpClient:  &http.Client{},
-	}
+	c = newClient(Credentials{
+		Username:    os.Getenv("QPAY_USERNAME"),
+		Password:    os.Getenv("QPAY_PASSWORD"),
+		InvoiceCode: os.Getenv("QPAY_INVOICE_CODE"),
+		MerchantID:  os.Getenv("QPAY_MERCHANT_ID"),
+	})
 	Client = c
 	return
 }
 
-func (c *QpayClient) login() (err error) {
-	url := os.Getenv("QPAY_URL") + "/auth/token"
-
-	// Create a new POST request
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(c.username, c.password)
-
-	// Send the request
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
+// ClientFor returns the client registered for key, creating it on first
+// use. A client whose credentials changed is replaced, dropping its tokens.
+func ClientFor(key string, creds Credentials) *QpayClient {
+	clientMu.Lock()
+	defer clientMu.Unlock()
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
+	c, ok := clients[key]
+	if !ok || c.credentials() != creds {
+		c = newClient(creds)
+		clients[key] = c
 	}
-	err = json.Unmarshal(body, c)
-	return
+	return c
 }
 
-func (c *QpayClient) checkAndUpdateAccessToken() (err error) {
-	now := time.Now()
-	if c.AccessToken == "" || now.After(time.Unix(c.AccessTokenExpire, 0)) {
-		err = c.login()
+func newClient(creds Credentials) *QpayClient {
+	return &QpayClient{
+		username:    creds.Username,
+		password:    creds.Password,
+		invoiceCode: creds.InvoiceCode,
+		merchantID:  creds.MerchantID,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
 	}
-	return
 }
 
-func (c *QpayClient) CreateInvoice(amount float64,
-	invoiceNumber, invoiceReceiverCode, callbackURL string, expiryDate time.Time) (req map[string]interface{}, res map[string]interface{}, err error) {
-
-	// checking and updating access token
-	err = c.checkAndUpdateAccessToken()
-	if err != nil {
-		return
+func (c *QpayClient) credentials() Credentials {
+	return Credentials{
+		Username:    c.username,
+		Password:    c.password,
+		InvoiceCode: c.invoiceCode,
+		MerchantID:  c.merchantID,
 	}
+}
 
-	// preparing body
-	req = map[string]interface{}{
-		"invoice_code":          c.invoiceCode,
-		"sender_invoice_no":     invoiceNumber,
-		"invoice_description":   invoiceNumber,
-		"invoice_receiver_code": invoiceReceiverCode,
-		"amount":                amount,
-		"callback_url":          callbackURL,
+// do sends an authorized JSON request to QPay and decodes the reply into out.
+// A 401 drops the cached token and the request is retried once.
+func (c *QpayClient) do(method, path string, in, out interface{}) (err error) {
+	var byteSlice []byte
+	if in != nil {
+		byteSlice, err = json.Marshal(in)
+		if err != nil {
+			return
+		}
 	}
 
-	req["expiry_date"] = expiryDate.Format("2006-01-02 15:04:05")
-
-	byteSlice, err := json.Marshal(req)
-	if err != nil {
-		return
-	}
+	url := os.Getenv("QPAY_URL") + path
+	for attempt := 0; ; attempt++ {
+		token, err := c.token()
+		if err != nil {
+			return err
+		}
 
-	// Create a new POST request
-	url := os.Getenv("QPAY_URL") + "/invoice"
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(byteSlice))
-	if err != nil {
-		return
+		var body io.Reader
+		if byteSlice != nil {
+			body = bytes.NewReader(byteSlice)
+		}
+		request, err := http.NewRequest(method, url, body)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		err = c.send(request, out)
+		var qErr *Error
+		if attempt == 0 && errors.As(err, &qErr) && qErr.StatusCode == http.StatusUnauthorized {
+			log.Warn().Msgf("QPay rejected access token on %s %s, retrying", method, path)
+			c.invalidateToken(token)
+			continue
+		}
+		return err
 	}
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AccessToken))
+}
 
-	// Send the request
+// send executes the request and decodes either the success payload into out
+// or the QPay error payload into an *Error.
+func (c *QpayClient) send(request *http.Request, out interface{}) (err error) {
 	resp, err := c.httpClient.Do(request)
 	if err != nil {
 		return
@@ -122,66 +149,104 @@ func (c *QpayClient) CreateInvoice(amount float64,
 		return
 	}
 
-	err = json.Unmarshal(body, &res)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		qErr := &Error{StatusCode: resp.StatusCode}
+		if jsonErr := json.Unmarshal(body, qErr); jsonErr != nil || qErr.Code == "" {
+			qErr.Code = http.StatusText(resp.StatusCode)
+			qErr.Message = string(body)
+		}
+		return qErr
+	}
+
+	if out == nil || len(body) == 0 {
+		return
+	}
+	if err = json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
 	return
 }
 
-func (c *QpayClient) CheckInvoice(InvoiceID string) (isPaid bool, paymentID string,  err error) {
-
-	// checking and updating access token
-	err = c.checkAndUpdateAccessToken()
-	if err != nil {
-		return
+func (c *QpayClient) CreateInvoice(req *InvoiceRequest) (res *InvoiceResponse, err error) {
+	if req.InvoiceCode == "" {
+		req.InvoiceCode = c.invoiceCode
 	}
 
-	// preparing body
-	req := map[string]interface{}{
-		"object_type": "INVOICE",
-		"object_id":   InvoiceID,
+	res = &InvoiceResponse{}
+	if err = c.do("POST", "/invoice", req, res); err != nil {
+		return nil, err
 	}
-	byteSlice, err := json.Marshal(req)
-	if err != nil {
-		return
+	if res.InvoiceID == "" {
+		return nil, fmt.Errorf("%w: missing invoice_id", ErrMalformedResponse)
 	}
+	return
+}
 
-	// Create a new POST request
-	url := os.Getenv("QPAY_URL") + "/payment/check"
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(byteSlice))
-	if err != nil {
-		return
+func (c *QpayClient) CheckInvoice(invoiceID string) (res *PaymentCheckResponse, err error) {
+	req := &PaymentCheckRequest{
+		ObjectType: "INVOICE",
+		ObjectID:   invoiceID,
+		Offset:     &Offset{PageNumber: 1, PageLimit: 100},
 	}
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AccessToken))
 
-	// Send the request
-	resp, err := c.httpClient.Do(request)
-	if err != nil {
-		return
+	res = &PaymentCheckResponse{}
+	if err = c.do("POST", "/payment/check", req, res); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
+	log.Info().Msgf("isPaid: %v, paymentID: %v, Check qpay: %+v", res.IsPaid(), res.PaymentID(), res)
+	return
+}
+
+// CancelInvoice voids an unpaid invoice at QPay.
+func (c *QpayClient) CancelInvoice(invoiceID string) (err error) {
+	return c.do("DELETE", "/invoice/"+url.PathEscape(invoiceID), nil, nil)
+}
+
+// CancelPayment cancels a payment. QPay only allows this for card payments
+// on the day they were made; use RefundPayment otherwise.
+func (c *QpayClient) CancelPayment(paymentID string, req *PaymentCancelRequest) (err error) {
+	return c.do("DELETE", "/payment/cancel/"+url.PathEscape(paymentID), req, nil)
+}
+
+// RefundPayment returns a payment to the payer.
+func (c *QpayClient) RefundPayment(paymentID string, req *PaymentCancelRequest) (err error) {
+	return c.do("DELETE", "/payment/refund/"+url.PathEscape(paymentID), req, nil)
+}
+
+// CreateEbarimt issues the VAT receipt (ebarimt) of a paid payment.
+func (c *QpayClient) CreateEbarimt(req *EbarimtRequest) (res *EbarimtResponse, err error) {
+	res = &EbarimtResponse{}
+	if err = c.do("POST", "/ebarimt/create", req, res); err != nil {
+		return nil, err
 	}
-	res := map[string]interface{}{}
-	err = json.Unmarshal(body, &res)
-	if err != nil {
-		return
+	if res.ID == "" {
+		return nil, fmt.Errorf("%w: missing ebarimt id", ErrMalformedResponse)
 	}
+	return
+}
 
-	// Retrieve and print the value of the "name" key
-	isPaid = res["count"].(float64) > 0
+// CancelEbarimt voids the VAT receipt of a payment, after a refund.
+func (c *QpayClient) CancelEbarimt(paymentID string) (err error) {
+	return c.do("DELETE", "/ebarimt/"+url.PathEscape(paymentID), nil, nil)
+}
 
-	if rows, ok := res["rows"].([]interface{}); ok && len(rows) > 0 {
-		if firstRow, ok := rows[0].(map[string]interface{}); ok {
-			if id, ok := firstRow["payment_id"].(string); ok {
-				paymentID = id
-			}
-		}
+// ListPayments returns one page of payments made to the merchant,
+// QPAY_MERCHANT_ID unless req names another one.
+func (c *QpayClient) ListPayments(req *PaymentListRequest) (res *PaymentListResponse, err error) {
+	if req.ObjectType == "" {
+		req.ObjectType = "MERCHANT"
+	}
+	if req.ObjectID == "" {
+		req.ObjectID = c.merchantID
+	}
+	if req.Offset == nil {
+		req.Offset = &Offset{PageNumber: 1, PageLimit: 100}
 	}
 
-	log.Info().Msgf("isPaid: %v, paymentID: %v,  Check qpay: %v", isPaid, paymentID, res)
+	res = &PaymentListResponse{}
+	if err = c.do("POST", "/payment/list", req, res); err != nil {
+		return nil, err
+	}
 	return
 }
@@ -0,0 +1,122 @@
+package qpay
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tokenExpirySkew is how long before the reported expiry a token is
+// considered stale, so requests in flight never carry an expired token.
+const tokenExpirySkew = 60 * time.Second
+
+// tokenManager caches the access and refresh tokens of a client. The mutex
+// is held for the whole refresh, so concurrent callers wait for a single
+// login instead of each starting their own.
+type tokenManager struct {
+	mu            sync.Mutex
+	accessToken   string
+	accessExpiry  time.Time
+	refreshToken  string
+	refreshExpiry time.Time
+}
+
+// token returns a valid access token, refreshing or logging in if needed.
+func (c *QpayClient) token() (string, error) {
+	t := &c.tokens
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.accessToken != "" && now.Add(tokenExpirySkew).Before(t.accessExpiry) {
+		return t.accessToken, nil
+	}
+
+	if t.refreshToken != "" && now.Add(tokenExpirySkew).Before(t.refreshExpiry) {
+		res, err := c.refresh(t.refreshToken)
+		if err == nil {
+			t.store(res, now)
+			return t.accessToken, nil
+		}
+		log.Warn().Err(err).Msg("QPay token refresh failed, logging in again")
+	}
+
+	res, err := c.login()
+	if err != nil {
+		t.accessToken, t.refreshToken = "", ""
+		return "", err
+	}
+	t.store(res, now)
+	return t.accessToken, nil
+}
+
+// invalidateToken drops the cached access token after QPay rejected it. The
+// token is only dropped if no other caller has replaced it in the meantime.
+func (c *QpayClient) invalidateToken(token string) {
+	t := &c.tokens
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.accessToken == token {
+		t.accessToken = ""
+	}
+}
+
+func (t *tokenManager) store(res *TokenResponse, now time.Time) {
+	t.accessToken = res.AccessToken
+	t.accessExpiry = expiryTime(res.ExpiresIn, now)
+	t.refreshToken = res.RefreshToken
+	t.refreshExpiry = expiryTime(res.RefreshExpiresIn, now)
+}
+
+// expiryTime converts an expires_in value to an absolute time. QPay has
+// returned both unix timestamps and relative seconds in this field.
+func expiryTime(v int64, now time.Time) time.Time {
+	if v > 1_000_000_000 {
+		return time.Unix(v, 0)
+	}
+	return now.Add(time.Duration(v) * time.Second)
+}
+
+func (c *QpayClient) login() (res *TokenResponse, err error) {
+	url := os.Getenv("QPAY_URL") + "/auth/token"
+
+	// Create a new POST request
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.username, c.password)
+
+	return c.sendToken(req)
+}
+
+func (c *QpayClient) refresh(refreshToken string) (res *TokenResponse, err error) {
+	url := os.Getenv("QPAY_URL") + "/auth/refresh"
+
+	// Create a new POST request
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", refreshToken))
+
+	return c.sendToken(req)
+}
+
+func (c *QpayClient) sendToken(req *http.Request) (res *TokenResponse, err error) {
+	res = &TokenResponse{}
+	if err = c.send(req, res); err != nil {
+		return nil, err
+	}
+	if res.AccessToken == "" {
+		return nil, fmt.Errorf("%w: empty access token", ErrMalformedResponse)
+	}
+	return
+}
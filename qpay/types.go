@@ -0,0 +1,255 @@
+package qpay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"qpay/money"
+	"time"
+)
+
+// ErrMalformedResponse is returned when QPay replies with a payload that
+// does not contain the fields we rely on.
+var ErrMalformedResponse = errors.New("malformed qpay response")
+
+// Error is the error payload QPay returns for non-2xx responses.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("qpay: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("qpay: %d %s", e.StatusCode, e.Code)
+}
+
+// TokenResponse is returned by /auth/token and /auth/refresh.
+type TokenResponse struct {
+	TokenType        string `json:"token_type"`
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	Scope            string `json:"scope"`
+	SessionState     string `json:"session_state"`
+}
+
+// InvoiceReceiverData describes the payer printed on the invoice.
+type InvoiceReceiverData struct {
+	Register string `json:"register,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+}
+
+// Discount is a discount applied to an invoice line.
+type Discount struct {
+	DiscountCode string       `json:"discount_code,omitempty"`
+	Description  string       `json:"description"`
+	Amount       money.Amount `json:"amount"`
+	Note         string       `json:"note,omitempty"`
+}
+
+// Surcharge is a surcharge applied to an invoice line.
+type Surcharge struct {
+	SurchargeCode string       `json:"surcharge_code,omitempty"`
+	Description   string       `json:"description"`
+	Amount        money.Amount `json:"amount"`
+	Note          string       `json:"note,omitempty"`
+}
+
+// Tax is a tax applied to an invoice line.
+type Tax struct {
+	TaxCode     string       `json:"tax_code,omitempty"`
+	Description string       `json:"description"`
+	Amount      money.Amount `json:"amount"`
+	Note        string       `json:"note,omitempty"`
+}
+
+// InvoiceLine is a single line of a detailed invoice.
+type InvoiceLine struct {
+	TaxProductCode  string       `json:"tax_product_code,omitempty"`
+	LineDescription string       `json:"line_description"`
+	LineQuantity    float64      `json:"line_quantity"`
+	LineUnitPrice   money.Amount `json:"line_unit_price"`
+	Note            string       `json:"note,omitempty"`
+	Discounts       []Discount   `json:"discounts,omitempty"`
+	Surcharges      []Surcharge  `json:"surcharges,omitempty"`
+	Taxes           []Tax        `json:"taxes,omitempty"`
+}
+
+// InvoiceRequest is the body of POST /invoice. Lines and receiver data are
+// only set for the detailed invoice form.
+type InvoiceRequest struct {
+	InvoiceCode         string               `json:"invoice_code"`
+	SenderInvoiceNo     string               `json:"sender_invoice_no"`
+	SenderBranchCode    string               `json:"sender_branch_code,omitempty"`
+	SenderStaffCode     string               `json:"sender_staff_code,omitempty"`
+	InvoiceReceiverCode string               `json:"invoice_receiver_code"`
+	InvoiceReceiverData *InvoiceReceiverData `json:"invoice_receiver_data,omitempty"`
+	InvoiceDescription  string               `json:"invoice_description"`
+	Amount              money.Amount         `json:"amount"`
+	AllowPartial        bool                 `json:"allow_partial,omitempty"`
+	MinimumAmount       money.Amount         `json:"minimum_amount,omitempty"`
+	AllowExceed         bool                 `json:"allow_exceed,omitempty"`
+	MaximumAmount       money.Amount         `json:"maximum_amount,omitempty"`
+	CallbackURL         string               `json:"callback_url"`
+	ExpiryDate          string               `json:"expiry_date,omitempty"`
+	Note                string               `json:"note,omitempty"`
+	Lines               []InvoiceLine        `json:"lines,omitempty"`
+}
+
+// Deeplink is a bank or wallet app link returned with an invoice.
+type Deeplink struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Logo        string `json:"logo"`
+	Link        string `json:"link"`
+}
+
+// InvoiceResponse is returned by POST /invoice.
+type InvoiceResponse struct {
+	InvoiceID    string     `json:"invoice_id"`
+	QrText       string     `json:"qr_text"`
+	QrImage      string     `json:"qr_image"`
+	QPayShortURL string     `json:"qPay_shortUrl"`
+	URLs         []Deeplink `json:"urls"`
+}
+
+// Offset is the paging block shared by QPay list endpoints.
+type Offset struct {
+	PageNumber int `json:"page_number"`
+	PageLimit  int `json:"page_limit"`
+}
+
+// PaymentCheckRequest is the body of POST /payment/check.
+type PaymentCheckRequest struct {
+	ObjectType string  `json:"object_type"`
+	ObjectID   string  `json:"object_id"`
+	Offset     *Offset `json:"offset,omitempty"`
+}
+
+// Payment is a single payment row as reported by QPay.
+type Payment struct {
+	PaymentID       string       `json:"payment_id"`
+	PaymentStatus   string       `json:"payment_status"`
+	PaymentDate     string       `json:"payment_date"`
+	PaymentFee      money.Amount `json:"payment_fee"`
+	PaymentAmount   money.Amount `json:"payment_amount"`
+	PaymentCurrency string       `json:"payment_currency"`
+	PaymentWallet   string       `json:"payment_wallet"`
+	TransactionType string       `json:"transaction_type"`
+}
+
+// PaymentCheckResponse is returned by POST /payment/check.
+type PaymentCheckResponse struct {
+	Count      int          `json:"count"`
+	PaidAmount money.Amount `json:"paid_amount"`
+	Rows       []Payment    `json:"rows"`
+}
+
+// IsPaid reports whether QPay holds at least one payment for the object.
+func (r *PaymentCheckResponse) IsPaid() bool {
+	return r.Count > 0 && len(r.Rows) > 0
+}
+
+// PaymentID returns the id of the first payment row, if any.
+func (r *PaymentCheckResponse) PaymentID() string {
+	if len(r.Rows) == 0 {
+		return ""
+	}
+	return r.Rows[0].PaymentID
+}
+
+// PaymentCancelRequest is the body of the payment cancel and refund calls.
+type PaymentCancelRequest struct {
+	CallbackURL string `json:"callback_url,omitempty"`
+	Note        string `json:"note,omitempty"`
+}
+
+// EbarimtReceiverType is who a VAT receipt is issued to.
+type EbarimtReceiverType string
+
+const (
+	EbarimtCitizen EbarimtReceiverType = "CITIZEN"
+	EbarimtCompany EbarimtReceiverType = "COMPANY"
+)
+
+// EbarimtRequest asks QPay to issue the VAT receipt of a payment. Receiver
+// is the register number of a company, or an optional citizen register or
+// phone number.
+type EbarimtRequest struct {
+	PaymentID           string              `json:"payment_id"`
+	EbarimtReceiverType EbarimtReceiverType `json:"ebarimt_receiver_type"`
+	EbarimtReceiver     string              `json:"ebarimt_receiver,omitempty"`
+	DistrictCode        string              `json:"district_code,omitempty"`
+	ClassificationCode  string              `json:"classification_code,omitempty"`
+}
+
+type EbarimtResponse struct {
+	ID                  string       `json:"id"`
+	EbarimtReceiverType string       `json:"ebarimt_receiver_type"`
+	EbarimtReceiver     string       `json:"ebarimt_receiver"`
+	Amount              money.Amount `json:"amount"`
+	VatAmount           money.Amount `json:"vat_amount"`
+	CityTaxAmount       money.Amount `json:"city_tax_amount"`
+	EbarimtQrData       string       `json:"ebarimt_qr_data"`
+	EbarimtLottery      string       `json:"ebarimt_lottery"`
+	BarimtStatus        string       `json:"barimt_status"`
+	Note                string       `json:"note"`
+}
+
+// PaymentListRequest lists the payments of a merchant between two dates,
+// formatted as "2006-01-02 15:04:05".
+type PaymentListRequest struct {
+	ObjectType           string  `json:"object_type"`
+	ObjectID             string  `json:"object_id"`
+	MerchantBranchCode   string  `json:"merchant_branch_code,omitempty"`
+	MerchantTerminalCode string  `json:"merchant_terminal_code,omitempty"`
+	MerchantStaffCode    string  `json:"merchant_staff_code,omitempty"`
+	StartDate            string  `json:"start_date,omitempty"`
+	EndDate              string  `json:"end_date,omitempty"`
+	Offset               *Offset `json:"offset"`
+}
+
+// PaymentListRow is a payment with the object it was made against. For
+// invoice payments ObjectID is the QPay invoice_id.
+type PaymentListRow struct {
+	Payment
+	PaymentName        string `json:"payment_name"`
+	PaymentDescription string `json:"payment_description"`
+	PaidBy             string `json:"paid_by"`
+	ObjectType         string `json:"object_type"`
+	ObjectID           string `json:"object_id"`
+}
+
+type PaymentListResponse struct {
+	Count int              `json:"count"`
+	Rows  []PaymentListRow `json:"rows"`
+}
+
+// ParseTime parses the payment_date formats QPay is known to send. Dates
+// without a zone are QPay's local time and are read in the configured
+// TIMEZONE.
+func ParseTime(s string) *time.Time {
+	loc, err := time.LoadLocation(os.Getenv("TIMEZONE"))
+	if err != nil {
+		loc = time.Local
+	}
+	for _, f := range []struct {
+		layout string
+		loc    *time.Location
+	}{
+		{time.RFC3339Nano, time.UTC},
+		{"2006-01-02T15:04:05.000Z", time.UTC},
+		{"2006-01-02 15:04:05", loc},
+	} {
+		if t, err := time.ParseInLocation(f.layout, s, f.loc); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
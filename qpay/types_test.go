@@ -0,0 +1,34 @@
+package qpay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	t.Setenv("TIMEZONE", "Asia/Ulaanbaatar")
+
+	tests := []struct {
+		name string
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"rfc3339", "2024-05-01T10:00:00+08:00", time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC), true},
+		{"millis utc", "2024-05-01T02:00:00.000Z", time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC), true},
+		{"local layout is ulaanbaatar", "2024-05-01 10:00:00", time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC), true},
+		{"empty", "", time.Time{}, false},
+		{"garbage", "yesterday", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseTime(tt.in)
+			if (got != nil) != tt.ok {
+				t.Fatalf("ParseTime(%q) = %v, want ok %v", tt.in, got, tt.ok)
+			}
+			if got != nil && !got.Equal(tt.want) {
+				t.Errorf("ParseTime(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
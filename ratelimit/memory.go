@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pruneEvery is how many takes pass between sweeps of full buckets.
+const pruneEvery = 1000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// full reports whether the bucket refilled by now, so dropping it changes
+// nothing.
+func (b *bucket) full(now time.Time) bool {
+	return b.limit.refill(b.tokens, now.Sub(b.last)) >= float64(b.limit.Burst)
+}
+
+// MemoryStore keeps buckets in this process, for a single instance.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	tokens := limit.refill(b.tokens, now.Sub(b.last))
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	b.tokens, b.last, b.limit = tokens, now, limit
+
+	if s.takes++; s.takes >= pruneEvery {
+		s.takes = 0
+		for k, b := range s.buckets {
+			if b.full(now) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+	return limit.result(tokens, allowed), nil
+}
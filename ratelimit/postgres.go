@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"context"
+	"qpay/models"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PostgresStore keeps buckets in the rate_limit_buckets table, shared by
+// every replica.
+type PostgresStore struct {
+	takes atomic.Int64
+}
+
+func NewPostgresStore() *PostgresStore {
+	return &PostgresStore{}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	b, err := models.TakeRateLimit(ctx, key, limit.rate(), limit.Burst)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if s.takes.Add(1)%pruneEvery == 0 {
+		go func() {
+			if err := models.PruneRateLimits(context.Background()); err != nil {
+				log.Error().Err(err).Msg("Could not prune rate limit buckets")
+			}
+		}()
+	}
+	return limit.result(b.Tokens, b.Allowed), nil
+}
@@ -0,0 +1,127 @@
+// Package ratelimit limits requests with token buckets kept in a Store.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket refilled with PerMinute tokens a minute, holding
+// at most Burst.
+type Limit struct {
+	PerMinute int
+	Burst     int
+}
+
+func (l Limit) Valid() bool {
+	return l.PerMinute > 0 && l.Burst > 0
+}
+
+// rate is the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.PerMinute) / 60
+}
+
+// refill adds the tokens earned over elapsed, up to the burst.
+func (l Limit) refill(tokens float64, elapsed time.Duration) float64 {
+	return math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.rate())
+}
+
+// result describes the bucket left with tokens after a take.
+func (l Limit) result(tokens float64, allowed bool) Result {
+	r := Result{
+		Allowed:   allowed,
+		Limit:     l.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     seconds((float64(l.Burst) - tokens) / l.rate()),
+	}
+	if !allowed {
+		r.RetryAfter = seconds((1 - tokens) / l.rate())
+	}
+	return r
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(math.Max(0, s))) * time.Second
+}
+
+// Result is the outcome of one take.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the bucket is full again
+	Reset time.Duration
+	// RetryAfter is when the next take succeeds, zero when allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Take refills the bucket of key, takes a token
+// when there is one, and reports what is left.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Limiter applies a default limit to every key and extra limits to some
+// routes.
+type Limiter struct {
+	Store   Store
+	Default Limit
+	// Routes are keyed by "METHOD /path" as registered with echo
+	Routes map[string]Limit
+}
+
+// Allow takes a token from the key's bucket of the route, for routes with
+// their own limit, then from the key's bucket. The route goes first so
+// its denials leave the key's other requests alone. The result is the
+// most restrictive of the two. keyLimit overrides the default when valid.
+func (l *Limiter) Allow(ctx context.Context, key, route string, keyLimit Limit) (Result, error) {
+	var routeRes *Result
+	if routeLimit, ok := l.Routes[route]; ok {
+		res, err := l.Store.Take(ctx, key+" "+route, routeLimit)
+		if err != nil || !res.Allowed {
+			return res, err
+		}
+		routeRes = &res
+	}
+
+	limit := l.Default
+	if keyLimit.Valid() {
+		limit = keyLimit
+	}
+	res, err := l.Store.Take(ctx, key, limit)
+	if err != nil || !res.Allowed {
+		return res, err
+	}
+	if routeRes != nil && routeRes.Remaining < res.Remaining {
+		return *routeRes, nil
+	}
+	return res, nil
+}
+
+// ParseRoutes parses route limits formatted as "METHOD /path=perMinute:burst",
+// e.g. "POST /api/v1/invoices=30:10".
+func ParseRoutes(specs []string) (map[string]Limit, error) {
+	routes := map[string]Limit{}
+	for _, spec := range specs {
+		route, value, ok := strings.Cut(spec, "=")
+		perMinute, burst, ok2 := strings.Cut(value, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("rate limit route %q must be METHOD /path=perMinute:burst", spec)
+		}
+		var limit Limit
+		var err error
+		if limit.PerMinute, err = strconv.Atoi(perMinute); err == nil {
+			limit.Burst, err = strconv.Atoi(burst)
+		}
+		if err != nil || !limit.Valid() {
+			return nil, fmt.Errorf("rate limit route %q must have positive perMinute and burst", spec)
+		}
+		routes[strings.Join(strings.Fields(route), " ")] = limit
+	}
+	return routes, nil
+}
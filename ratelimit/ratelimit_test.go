@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	l := Limit{PerMinute: 60, Burst: 10}
+	tests := []struct {
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0, 0},
+		{0, time.Second, 1},
+		{2.5, 1500 * time.Millisecond, 4},
+		{9, 5 * time.Second, 10},
+		{10, time.Hour, 10},
+	}
+	for _, tt := range tests {
+		if got := l.refill(tt.tokens, tt.elapsed); got != tt.want {
+			t.Errorf("refill(%v, %v) = %v, want %v", tt.tokens, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestResult(t *testing.T) {
+	l := Limit{PerMinute: 30, Burst: 5}
+	tests := []struct {
+		tokens  float64
+		allowed bool
+		want    Result
+	}{
+		{4, true, Result{Allowed: true, Limit: 5, Remaining: 4, Reset: 2 * time.Second}},
+		{0, true, Result{Allowed: true, Limit: 5, Remaining: 0, Reset: 10 * time.Second}},
+		{0.5, false, Result{Allowed: false, Limit: 5, Remaining: 0, Reset: 9 * time.Second, RetryAfter: time.Second}},
+		{0.1, false, Result{Allowed: false, Limit: 5, Remaining: 0, Reset: 10 * time.Second, RetryAfter: 2 * time.Second}},
+		{5, true, Result{Allowed: true, Limit: 5, Remaining: 5, Reset: 0}},
+	}
+	for _, tt := range tests {
+		if got := l.result(tt.tokens, tt.allowed); got != tt.want {
+			t.Errorf("result(%v, %v) = %+v, want %+v", tt.tokens, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	// one token a minute, so nothing refills during the test
+	l := Limit{PerMinute: 1, Burst: 3}
+
+	for n, want := range []int{2, 1, 0} {
+		res, err := s.Take(ctx, "a", l)
+		if err != nil || !res.Allowed || res.Remaining != want {
+			t.Fatalf("take %d = %+v, %v, want allowed with %d remaining", n, res, err, want)
+		}
+	}
+	res, _ := s.Take(ctx, "a", l)
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > time.Minute {
+		t.Errorf("take past the burst = %+v, want denied with a retry within a minute", res)
+	}
+	if res, _ = s.Take(ctx, "b", l); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("take of another key = %+v, want its own full bucket", res)
+	}
+}
+
+// countStore allows a key's takes up to its budget.
+type countStore struct {
+	budget map[string]int
+	takes  map[string]int
+}
+
+func (s *countStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	s.takes[key]++
+	left := s.budget[key] - s.takes[key]
+	return Result{Allowed: left >= 0, Limit: limit.Burst, Remaining: max(left, 0)}, nil
+}
+
+func TestLimiterAllow(t *testing.T) {
+	route := "POST /api/v1/invoices"
+	tests := []struct {
+		name      string
+		budget    map[string]int
+		route     string
+		keyLimit  Limit
+		allowed   bool
+		remaining int
+		limit     int
+		keyTakes  int
+	}{
+		{"default only", map[string]int{"k": 5}, "GET /", Limit{}, true, 4, 60, 1},
+		{"key limit overrides default", map[string]int{"k": 5}, "GET /", Limit{PerMinute: 10, Burst: 7}, true, 4, 7, 1},
+		{"route is stricter", map[string]int{"k": 5, "k " + route: 2}, route, Limit{}, true, 1, 10, 1},
+		{"key is stricter", map[string]int{"k": 1, "k " + route: 5}, route, Limit{}, true, 0, 60, 1},
+		{"route denial leaves the key alone", map[string]int{"k": 5}, route, Limit{}, false, 0, 10, 0},
+		{"key denial", map[string]int{"k": 0, "k " + route: 5}, route, Limit{}, false, 0, 60, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &countStore{budget: tt.budget, takes: map[string]int{}}
+			l := &Limiter{
+				Store:   store,
+				Default: Limit{PerMinute: 120, Burst: 60},
+				Routes:  map[string]Limit{route: {PerMinute: 30, Burst: 10}},
+			}
+			res, err := l.Allow(context.Background(), "k", tt.route, tt.keyLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed != tt.allowed || res.Remaining != tt.remaining || res.Limit != tt.limit {
+				t.Errorf("Allow = %+v, want allowed %v, remaining %d, limit %d", res, tt.allowed, tt.remaining, tt.limit)
+			}
+			if store.takes["k"] != tt.keyTakes {
+				t.Errorf("key bucket taken %d times, want %d", store.takes["k"], tt.keyTakes)
+			}
+		})
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes([]string{"POST /api/v1/invoices=30:10", "GET   /pay/:invoiceID=60:20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Limit{
+		"POST /api/v1/invoices": {PerMinute: 30, Burst: 10},
+		"GET /pay/:invoiceID":   {PerMinute: 60, Burst: 20},
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("ParseRoutes = %v, want %v", routes, want)
+	}
+	for route, limit := range want {
+		if routes[route] != limit {
+			t.Errorf("route %q = %+v, want %+v", route, routes[route], limit)
+		}
+	}
+
+	for _, spec := range []string{"POST /api/v1/invoices", "POST /api/v1/invoices=30", "POST /x=a:10", "POST /x=30:0", "POST /x=-1:10"} {
+		if _, err := ParseRoutes([]string{spec}); err == nil {
+			t.Errorf("ParseRoutes(%q) succeeded, want an error", spec)
+		}
+	}
+}
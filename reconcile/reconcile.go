@@ -0,0 +1,252 @@
+// Package reconcile compares the payments QPay settled with the ones
+// recorded locally.
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"qpay/helpers"
+	"qpay/models"
+	"qpay/money"
+	q "qpay/qpay"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoMerchant = errors.New("QPay merchant ID of the merchant is not configured")
+
+type Class string
+
+const (
+	Matched            Class = "matched"
+	MissingLocally     Class = "missing_locally"
+	LocalPaidNotAtQpay Class = "local_paid_not_at_qpay"
+	AmountMismatch     Class = "amount_mismatch"
+	// Flagged payments were flagged locally, see models.ReconcileFlag
+	Flagged Class = "flagged"
+)
+
+const (
+	pageLimit = 100
+	// payments near midnight may be dated differently by QPay and us, so
+	// both sides are looked up with this margin around the day
+	dayMargin = time.Hour
+	// dateLayout is QPay's local time; days from helpers.Day are already in
+	// the configured timezone and q.ParseTime reads dates back in it
+	dateLayout = "2006-01-02 15:04:05"
+)
+
+// Item is one payment of the report. Amounts are zero on the side that
+// does not know the payment.
+type Item struct {
+	Class         Class             `json:"class"`
+	PaymentID     string            `json:"paymentID"`
+	InvoiceID     string            `json:"invoiceID,omitempty"`
+	InvoiceNumber string            `json:"invoiceNumber,omitempty"`
+	QpayAmount    money.Amount      `json:"qpayAmount"`
+	LocalAmount   money.Amount      `json:"localAmount"`
+	PaidAt        *time.Time        `json:"paidAt,omitempty"`
+	Reason        models.FlagReason `json:"reason,omitempty"`
+	Fixed         bool              `json:"fixed,omitempty"`
+	FixError      string            `json:"fixError,omitempty"`
+}
+
+type Report struct {
+	MerchantID uuid.UUID     `json:"merchantID"`
+	Date       string        `json:"date"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Counts     map[Class]int `json:"counts"`
+	Items      []Item        `json:"items"`
+}
+
+// Run reconciles the payments of one merchant for one day in the
+// configured timezone. With autoFix, invoices of payments missing locally
+// are re-checked with QPay and their payments applied.
+func Run(ctx context.Context, merchant *models.Merchant, date time.Time, autoFix bool) (report *Report, err error) {
+	if merchant.QpayMerchantID == "" {
+		return nil, ErrNoMerchant
+	}
+	from, to, err := helpers.Day(date)
+	if err != nil {
+		return
+	}
+
+	qpayClient, err := merchant.Client()
+	if err != nil {
+		return
+	}
+	remote, err := listRemote(qpayClient, merchant.QpayMerchantID, from.Add(-dayMargin), to.Add(dayMargin))
+	if err != nil {
+		return
+	}
+	local, err := models.ListPaidPayments(ctx, merchant.ID, from.Add(-dayMargin), to.Add(dayMargin))
+	if err != nil {
+		return
+	}
+
+	localByID := make(map[string]models.InvoicePayment, len(local))
+	for _, p := range local {
+		localByID[p.PaymentID] = p
+	}
+	remoteByID := make(map[string]q.PaymentListRow, len(remote))
+	for _, r := range remote {
+		remoteByID[r.PaymentID] = r
+	}
+	inDay := func(t *time.Time) bool {
+		return t == nil || (!t.Before(from) && t.Before(to))
+	}
+
+	report = &Report{
+		MerchantID: merchant.ID,
+		Date:       from.Format("2006-01-02"),
+		From:       from,
+		To:         to,
+		Counts:     map[Class]int{Matched: 0, MissingLocally: 0, LocalPaidNotAtQpay: 0, AmountMismatch: 0, Flagged: 0},
+		Items:      []Item{},
+	}
+	for _, r := range remote {
+		paidAt := q.ParseTime(r.PaymentDate)
+		if !inDay(paidAt) {
+			continue
+		}
+		item := Item{
+			PaymentID:  r.PaymentID,
+			InvoiceID:  r.ObjectID,
+			QpayAmount: r.PaymentAmount,
+			PaidAt:     paidAt,
+		}
+		if p, ok := localByID[r.PaymentID]; !ok {
+			item.Class = MissingLocally
+		} else {
+			item.InvoiceNumber = p.InvoiceNumber
+			item.LocalAmount = p.Amount
+			item.Class = Matched
+			if p.Amount != r.PaymentAmount {
+				item.Class = AmountMismatch
+			}
+		}
+		report.add(item)
+	}
+	for _, p := range local {
+		paidAt := p.PaidAt
+		if paidAt == nil {
+			paidAt = &p.CreatedAt
+		}
+		if _, ok := remoteByID[p.PaymentID]; ok || !inDay(paidAt) {
+			continue
+		}
+		report.add(Item{
+			Class:         LocalPaidNotAtQpay,
+			PaymentID:     p.PaymentID,
+			InvoiceID:     p.QpayInvoiceID,
+			InvoiceNumber: p.InvoiceNumber,
+			LocalAmount:   p.Amount,
+			PaidAt:        paidAt,
+		})
+	}
+
+	flags, err := models.ListReconcileFlags(ctx, merchant.ID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range flags {
+		report.add(Item{
+			Class:         Flagged,
+			PaymentID:     f.PaymentID,
+			InvoiceID:     f.QpayInvoiceID,
+			InvoiceNumber: f.InvoiceNumber,
+			QpayAmount:    remoteByID[f.PaymentID].PaymentAmount,
+			LocalAmount:   localByID[f.PaymentID].Amount,
+			PaidAt:        localByID[f.PaymentID].PaidAt,
+			Reason:        f.Reason,
+		})
+	}
+
+	if autoFix {
+		fixMissing(ctx, qpayClient, merchant.ID, report, remoteByID)
+	}
+	return
+}
+
+func (r *Report) add(item Item) {
+	r.Counts[item.Class]++
+	r.Items = append(r.Items, item)
+}
+
+// listRemote pages through the paid payments of the merchant.
+func listRemote(qpayClient *q.QpayClient, merchantID string, from, to time.Time) (rows []q.PaymentListRow, err error) {
+	for page := 1; ; page++ {
+		res, err := qpayClient.ListPayments(&q.PaymentListRequest{
+			ObjectID:  merchantID,
+			StartDate: from.Format(dateLayout),
+			EndDate:   to.Format(dateLayout),
+			Offset:    &q.Offset{PageNumber: page, PageLimit: pageLimit},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range res.Rows {
+			if models.PaymentStatus(row.PaymentStatus) == models.PaymentPaid {
+				rows = append(rows, row)
+			}
+		}
+		if len(res.Rows) < pageLimit || page*pageLimit >= res.Count {
+			return rows, nil
+		}
+	}
+}
+
+// fixMissing applies QPay's payments to the local invoices of payments
+// missing locally. Each invoice is checked once.
+func fixMissing(ctx context.Context, qpayClient *q.QpayClient, merchantID uuid.UUID, report *Report, remote map[string]q.PaymentListRow) {
+	checked := map[string]*q.PaymentCheckResponse{}
+	failed := map[string]error{}
+
+	for n := range report.Items {
+		item := &report.Items[n]
+		if item.Class != MissingLocally {
+			continue
+		}
+		if remote[item.PaymentID].ObjectType != "INVOICE" || item.InvoiceID == "" {
+			item.FixError = "payment was not made against an invoice"
+			continue
+		}
+
+		if _, ok := checked[item.InvoiceID]; !ok && failed[item.InvoiceID] == nil {
+			check, err := applyInvoice(ctx, qpayClient, merchantID, item.InvoiceID)
+			if err != nil {
+				failed[item.InvoiceID] = err
+			} else {
+				checked[item.InvoiceID] = check
+			}
+		}
+		if err := failed[item.InvoiceID]; err != nil {
+			item.FixError = err.Error()
+			continue
+		}
+		item.Fixed = models.HasPayment(checked[item.InvoiceID], item.PaymentID)
+		if !item.Fixed {
+			item.FixError = "payment not listed by invoice check"
+		}
+	}
+}
+
+func applyInvoice(ctx context.Context, qpayClient *q.QpayClient, merchantID uuid.UUID, invoiceID string) (*q.PaymentCheckResponse, error) {
+	invoice := models.Invoice{InvoiceID: invoiceID}
+	if err := invoice.ReadForInvoiceID(ctx); err != nil {
+		return nil, err
+	}
+	if invoice.MerchantID != merchantID {
+		return nil, models.ErrNotFound
+	}
+	check, err := qpayClient.CheckInvoice(invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if err = invoice.ApplyPaymentCheck(ctx, check, models.ActorReconciler); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
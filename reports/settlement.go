@@ -0,0 +1,277 @@
+// Package reports builds the finance reports of collected payments.
+package reports
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"qpay/helpers"
+	"qpay/models"
+	"qpay/money"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/xuri/excelize/v2"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+// SettlementPayment is a payment collected on the report day.
+type SettlementPayment struct {
+	PaidAt        time.Time            `json:"paidAt"`
+	InvoiceNumber string               `json:"invoiceNumber"`
+	InvoiceID     string               `json:"invoiceID"`
+	PaymentID     string               `json:"paymentID"`
+	Wallet        string               `json:"wallet,omitempty"`
+	Status        models.PaymentStatus `json:"status"`
+	Amount        money.Amount         `json:"amount"`
+	Fee           money.Amount         `json:"fee"`
+	Net           money.Amount         `json:"net"`
+}
+
+// SettlementRefund is a payment refunded on the report day, whenever it
+// was collected.
+type SettlementRefund struct {
+	RefundedAt    time.Time    `json:"refundedAt"`
+	InvoiceNumber string       `json:"invoiceNumber"`
+	InvoiceID     string       `json:"invoiceID"`
+	PaymentID     string       `json:"paymentID"`
+	Amount        money.Amount `json:"amount"`
+}
+
+type SettlementTotals struct {
+	PaymentCount int          `json:"paymentCount"`
+	InvoiceCount int          `json:"invoiceCount"`
+	Gross        money.Amount `json:"gross"`
+	Fees         money.Amount `json:"fees"`
+	RefundCount  int          `json:"refundCount"`
+	Refunds      money.Amount `json:"refunds"`
+	Net          money.Amount `json:"net"`
+}
+
+// Settlement is the report of one day: what was collected, what QPay kept
+// as fees and what was refunded.
+type Settlement struct {
+	Date       string              `json:"date"`
+	MerchantID uuid.UUID           `json:"merchantID"`
+	Merchant   string              `json:"merchant"`
+	From       time.Time           `json:"from"`
+	To         time.Time           `json:"to"`
+	Payments   []SettlementPayment `json:"payments"`
+	Refunds    []SettlementRefund  `json:"refunds"`
+	Totals     SettlementTotals    `json:"totals"`
+}
+
+// BuildSettlement builds the settlement report of the merchant for date's
+// day in the configured timezone.
+func BuildSettlement(ctx context.Context, merchant *models.Merchant, date time.Time) (s *Settlement, err error) {
+	from, to, err := helpers.Day(date)
+	if err != nil {
+		return
+	}
+	collected, err := models.ListCollectedPayments(ctx, merchant.ID, from, to)
+	if err != nil {
+		return
+	}
+	refunded, err := models.ListRefundedPayments(ctx, merchant.ID, from, to)
+	if err != nil {
+		return
+	}
+
+	s = &Settlement{
+		Date:       from.Format("2006-01-02"),
+		MerchantID: merchant.ID,
+		Merchant:   merchant.Name,
+		From:       from,
+		To:         to,
+		Payments:   make([]SettlementPayment, 0, len(collected)),
+		Refunds:    make([]SettlementRefund, 0, len(refunded)),
+	}
+
+	invoices := map[string]bool{}
+	for _, p := range collected {
+		paidAt := p.CreatedAt
+		if p.PaidAt != nil {
+			paidAt = *p.PaidAt
+		}
+		s.Payments = append(s.Payments, SettlementPayment{
+			PaidAt:        paidAt.In(from.Location()),
+			InvoiceNumber: p.InvoiceNumber,
+			InvoiceID:     p.QpayInvoiceID,
+			PaymentID:     p.PaymentID,
+			Wallet:        p.Wallet,
+			Status:        p.Status,
+			Amount:        p.Amount,
+			Fee:           p.Fee,
+			Net:           p.Amount - p.Fee,
+		})
+		invoices[p.QpayInvoiceID] = true
+		s.Totals.Gross += p.Amount
+		s.Totals.Fees += p.Fee
+	}
+	for _, p := range refunded {
+		s.Refunds = append(s.Refunds, SettlementRefund{
+			RefundedAt:    p.InvoiceRefundedAt.In(from.Location()),
+			InvoiceNumber: p.InvoiceNumber,
+			InvoiceID:     p.QpayInvoiceID,
+			PaymentID:     p.PaymentID,
+			Amount:        p.Amount,
+		})
+		s.Totals.Refunds += p.Amount
+	}
+
+	s.Totals.PaymentCount = len(s.Payments)
+	s.Totals.InvoiceCount = len(invoices)
+	s.Totals.RefundCount = len(s.Refunds)
+	s.Totals.Net = s.Totals.Gross - s.Totals.Fees - s.Totals.Refunds
+	return
+}
+
+// Filename is the download name of the report with the given extension.
+// The merchant is named by its ID, names are not safe in a header.
+func (s *Settlement) Filename(ext string) string {
+	return fmt.Sprintf("settlement-%s-%s.%s", s.MerchantID, s.Date, ext)
+}
+
+var (
+	paymentHeader = []string{"Paid at", "Invoice number", "Invoice ID", "Payment ID", "Wallet", "Status", "Amount", "Fee", "Net"}
+	refundHeader  = []string{"Refunded at", "Invoice number", "Invoice ID", "Payment ID", "Amount"}
+)
+
+func (s *Settlement) summary() [][]string {
+	return [][]string{
+		{"Date", s.Date},
+		{"Merchant", s.Merchant},
+		{"Merchant ID", s.MerchantID.String()},
+		{"Payments", strconv.Itoa(s.Totals.PaymentCount)},
+		{"Invoices", strconv.Itoa(s.Totals.InvoiceCount)},
+		{"Gross", s.Totals.Gross.String()},
+		{"Fees", s.Totals.Fees.String()},
+		{"Refunds", s.Totals.Refunds.String()},
+		{"Refund count", strconv.Itoa(s.Totals.RefundCount)},
+		{"Net", s.Totals.Net.String()},
+	}
+}
+
+// WriteCSV writes the summary, the payments and the refunds as blocks
+// separated by empty lines.
+func (s *Settlement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	records := s.summary()
+	records = append(records, nil, paymentHeader)
+	for _, p := range s.Payments {
+		records = append(records, []string{
+			p.PaidAt.Format(timeLayout), p.InvoiceNumber, p.InvoiceID, p.PaymentID, p.Wallet,
+			string(p.Status), p.Amount.String(), p.Fee.String(), p.Net.String(),
+		})
+	}
+	records = append(records, nil, refundHeader)
+	for _, r := range s.Refunds {
+		records = append(records, []string{
+			r.RefundedAt.Format(timeLayout), r.InvoiceNumber, r.InvoiceID, r.PaymentID, r.Amount.String(),
+		})
+	}
+	for _, record := range records {
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteXLSX writes the report as a workbook with Summary, Payments and
+// Refunds sheets. Amounts are numeric cells.
+func (s *Settlement) WriteXLSX(w io.Writer) (err error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	amountStyle, err := f.NewStyle(&excelize.Style{CustomNumFmt: ptr("#,##0.00")})
+	if err != nil {
+		return
+	}
+
+	const summarySheet = "Summary"
+	if err = f.SetSheetName("Sheet1", summarySheet); err != nil {
+		return
+	}
+	for n, row := range s.summary() {
+		if err = f.SetSheetRow(summarySheet, cell(1, n+1), &[]interface{}{row[0], row[1]}); err != nil {
+			return
+		}
+	}
+	totals := []struct {
+		row    int
+		amount money.Amount
+	}{{5, s.Totals.Gross}, {6, s.Totals.Fees}, {7, s.Totals.Refunds}, {9, s.Totals.Net}}
+	for _, t := range totals {
+		if err = f.SetCellValue(summarySheet, cell(2, t.row), t.amount.Float()); err != nil {
+			return
+		}
+		if err = f.SetCellStyle(summarySheet, cell(2, t.row), cell(2, t.row), amountStyle); err != nil {
+			return
+		}
+	}
+
+	payments := make([][]interface{}, 0, len(s.Payments))
+	for _, p := range s.Payments {
+		payments = append(payments, []interface{}{
+			p.PaidAt.Format(timeLayout), p.InvoiceNumber, p.InvoiceID, p.PaymentID, p.Wallet,
+			string(p.Status), p.Amount.Float(), p.Fee.Float(), p.Net.Float(),
+		})
+	}
+	if err = writeSheet(f, "Payments", paymentHeader, payments, []int{7, 8, 9}, amountStyle); err != nil {
+		return
+	}
+
+	refunds := make([][]interface{}, 0, len(s.Refunds))
+	for _, r := range s.Refunds {
+		refunds = append(refunds, []interface{}{
+			r.RefundedAt.Format(timeLayout), r.InvoiceNumber, r.InvoiceID, r.PaymentID, r.Amount.Float(),
+		})
+	}
+	if err = writeSheet(f, "Refunds", refundHeader, refunds, []int{5}, amountStyle); err != nil {
+		return
+	}
+
+	_, err = f.WriteTo(w)
+	return
+}
+
+func writeSheet(f *excelize.File, sheet string, header []string, rows [][]interface{}, amountCols []int, amountStyle int) (err error) {
+	if _, err = f.NewSheet(sheet); err != nil {
+		return
+	}
+	headerRow := make([]interface{}, len(header))
+	for n, h := range header {
+		headerRow[n] = h
+	}
+	if err = f.SetSheetRow(sheet, cell(1, 1), &headerRow); err != nil {
+		return
+	}
+	for n, row := range rows {
+		if err = f.SetSheetRow(sheet, cell(1, n+2), &row); err != nil {
+			return
+		}
+	}
+	if len(rows) == 0 {
+		return
+	}
+	for _, col := range amountCols {
+		if err = f.SetCellStyle(sheet, cell(col, 2), cell(col, len(rows)+1), amountStyle); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func cell(col, row int) string {
+	name, _ := excelize.CoordinatesToCellName(col, row)
+	return name
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	c "qpay/controllers"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+func APIKeyRoute(e *echo.Echo) {
+	e.GET("/api/v1/api-keys", c.ListAPIKeys, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.POST("/api/v1/api-keys", c.CreateAPIKey, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.POST("/api/v1/api-keys/:id/rotate", c.RotateAPIKey, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.DELETE("/api/v1/api-keys/:id", c.RevokeAPIKey, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+}
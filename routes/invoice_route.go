@@ -3,13 +3,25 @@ package routes
 
 import (
 	c "qpay/controllers"
+	"qpay/models"
 	m "qpay/routes/middlewares"
 
 	"github.com/labstack/echo/v4"
 )
 
 func InvoiceRoute(e *echo.Echo) {
-	e.POST("/api/v1/invoices", c.CreateInvoice, m.HeaderAuth)
-	e.GET("/api/v1/invoices/:invoiceID", c.CheckInvoice, m.HeaderAuth)
-	e.GET("/api/v1/invoices/callback/:callbackID", c.Callback)
+	read := m.RequireScope(models.ScopeInvoicesRead)
+	create := m.RequireScope(models.ScopeInvoicesCreate)
+
+	e.GET("/api/v1/invoices", c.ListInvoices, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.POST("/api/v1/invoices", c.CreateInvoice, m.RateLimitIP, m.HeaderAuth, m.RateLimit, create)
+	e.GET("/api/v1/invoices/:invoiceID", c.CheckInvoice, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.DELETE("/api/v1/invoices/:invoiceID", c.CancelInvoice, m.RateLimitIP, m.HeaderAuth, m.RateLimit, create)
+	e.GET("/api/v1/invoices/:invoiceID/detail", c.GetInvoiceDetail, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.GET("/api/v1/invoices/:invoiceID/qr.png", c.InvoiceQRPNG, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.GET("/api/v1/invoices/:invoiceID/qr.svg", c.InvoiceQRSVG, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.POST("/api/v1/invoices/:invoiceID/refund", c.RefundInvoice, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.RequireScope(models.ScopeRefunds))
+	e.GET("/api/v1/invoices/:invoiceID/events", c.ListInvoiceEvents, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.GET("/api/v1/invoices/:invoiceID/events/stream", c.StreamInvoiceEvents, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.GET("/api/v1/invoices/callback/:callbackID", c.Callback, m.RateLimitCallback)
 }
@@ -2,12 +2,15 @@ package routes
 
 import (
 	c "qpay/controllers"
+	"qpay/models"
 	m "qpay/routes/middlewares"
 
 	"github.com/labstack/echo/v4"
 )
 
 func MailRoute(e *echo.Echo) {
-	e.POST("/api/v1/mail/invoice", c.SendInvoiceEmail, m.HeaderAuth)
-	e.POST("/api/v1/mail/confirmed", c.SendConfirmedEmail, m.HeaderAuth)
+	send := m.RequireScope(models.ScopeMailSend)
+
+	e.POST("/api/v1/mail/invoice", c.SendInvoiceEmail, m.RateLimitIP, m.HeaderAuth, m.RateLimit, send)
+	e.POST("/api/v1/mail/confirmed", c.SendConfirmedEmail, m.RateLimitIP, m.HeaderAuth, m.RateLimit, send)
 }
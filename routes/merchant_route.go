@@ -0,0 +1,16 @@
+package routes
+
+import (
+	c "qpay/controllers"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+func MerchantRoute(e *echo.Echo) {
+	e.GET("/api/v1/merchants", c.ListMerchants, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.POST("/api/v1/merchants", c.CreateMerchant, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.GET("/api/v1/merchants/:merchantID", c.GetMerchant, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.PATCH("/api/v1/merchants/:merchantID", c.UpdateMerchant, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+	e.POST("/api/v1/merchants/:merchantID/webhook-secret", c.RotateWebhookSecret, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+}
@@ -2,18 +2,29 @@ package middlewares
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"net"
 	"net/http"
 	"os"
+	"qpay/config"
+	"qpay/models"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 )
 
 func PopulateContext(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		// Streams stay open until the client leaves, no request timeout
+		if strings.HasSuffix(c.Path(), "/stream") {
+			return next(c)
+		}
+
 		timeout, err := strconv.Atoi(os.Getenv("TIMEOUT"))
 		if err != nil {
 			timeout = 10 // Default timeout
@@ -60,7 +71,24 @@ func IPAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-// HeaderAuth validates requests using the X-API-KEY header
+// Principal is who a request acts as, resolved from its API key.
+type Principal struct {
+	// Key is nil for the bootstrap API_KEY
+	Key *models.APIKey
+	// Merchant is nil for admin keys, which act for every merchant
+	Merchant *models.Merchant
+	Scopes   []models.Scope
+}
+
+// Has reports whether the principal was granted scope.
+func (p *Principal) Has(scope models.Scope) bool {
+	return models.HasScope(p.Scopes, scope)
+}
+
+const principalKey = "principal"
+
+// HeaderAuth validates requests using the X-API-KEY header and attaches
+// the resolved Principal to the context
 func HeaderAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// If it's an OPTIONS request (the preflight), just return 200 OK and skip auth
@@ -71,17 +99,84 @@ func HeaderAuth(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		key := c.Request().Header.Get("X-API-KEY")
-		expectedKey := os.Getenv("API_KEY")
+		if key == "" {
+			return echo.ErrUnauthorized
+		}
+
+		// The API_KEY of the deployment, when set, is a bootstrap admin key
+		// for creating the stored ones
+		if bootstrap := config.AppConfig.App.APIKey; bootstrap != "" && equalKeys(key, bootstrap) {
+			c.Set(principalKey, &Principal{Scopes: []models.Scope{models.ScopeAdmin}})
+			return next(c)
+		}
 
-		if key != expectedKey {
+		ctx := c.Request().Context()
+		var apiKey models.APIKey
+		if err := apiKey.ReadForKey(ctx, key); errors.Is(err, models.ErrAPIKeyNotFound) {
 			c.Logger().Warn("Invalid API Key provided")
 			return echo.ErrUnauthorized
+		} else if err != nil {
+			log.Error().Err(err).Msg("Could not read API key")
+			return echo.ErrInternalServerError
+		}
+
+		principal := &Principal{Key: &apiKey, Scopes: apiKey.Scopes}
+		if !apiKey.Has(models.ScopeAdmin) {
+			merchant := models.Merchant{ID: apiKey.MerchantID}
+			if err := merchant.Read(ctx); err != nil || !merchant.Active {
+				c.Logger().Warnf("API key %v of unknown or inactive merchant", apiKey.Prefix)
+				return echo.ErrUnauthorized
+			}
+			principal.Merchant = &merchant
 		}
 
+		if err := apiKey.Touch(ctx); err != nil {
+			log.Error().Err(err).Msgf("Could not record use of API key %v", apiKey.Prefix)
+		}
+		c.Set(principalKey, principal)
+
 		return next(c)
 	}
 }
 
+// equalKeys compares keys in constant time. Hashing first hides the length
+// of the expected key.
+func equalKeys(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// GetPrincipal returns the principal HeaderAuth attached, nil on public
+// routes.
+func GetPrincipal(c echo.Context) *Principal {
+	p, _ := c.Get(principalKey).(*Principal)
+	return p
+}
+
+// Merchant returns the merchant of the request's API key, or nil for
+// admin keys, which act for every merchant.
+func Merchant(c echo.Context) *models.Merchant {
+	if p := GetPrincipal(c); p != nil {
+		return p.Merchant
+	}
+	return nil
+}
+
+// RequireScope rejects keys without the scope. Use after HeaderAuth.
+func RequireScope(scope models.Scope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if p := GetPrincipal(c); p == nil || !p.Has(scope) {
+				return echo.ErrForbidden
+			}
+			return next(c)
+		}
+	}
+}
+
+// AdminOnly rejects keys without the admin scope. Use after HeaderAuth.
+var AdminOnly = RequireScope(models.ScopeAdmin)
+
 // isPrivateIP checks if an IP address belongs to private ranges
 func isPrivateIP(ip string) bool {
 	privateRanges := []string{
@@ -0,0 +1,124 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"qpay/config"
+	"qpay/ratelimit"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	limiter *ratelimit.Limiter
+	ipLimit ratelimit.Limit
+)
+
+// SetupRateLimit builds the limiter of RateLimit from the configuration.
+// RATE_LIMIT_STORE picks memory (single instance), postgres (shared by
+// replicas) or off.
+func SetupRateLimit() error {
+	cfg := config.AppConfig.RateLimit
+
+	var store ratelimit.Store
+	switch cfg.Store {
+	case "off":
+		limiter = nil
+		return nil
+	case "memory":
+		store = ratelimit.NewMemoryStore()
+	case "postgres":
+		store = ratelimit.NewPostgresStore()
+	default:
+		return fmt.Errorf("unknown RATE_LIMIT_STORE %q, use memory, postgres or off", cfg.Store)
+	}
+
+	def := ratelimit.Limit{PerMinute: cfg.PerMinute, Burst: cfg.Burst}
+	if !def.Valid() {
+		return fmt.Errorf("RATE_LIMIT_PER_MINUTE and RATE_LIMIT_BURST must be positive")
+	}
+	ipLimit = ratelimit.Limit{PerMinute: cfg.IPPerMinute, Burst: cfg.IPBurst}
+	if !ipLimit.Valid() {
+		return fmt.Errorf("RATE_LIMIT_IP_PER_MINUTE and RATE_LIMIT_IP_BURST must be positive")
+	}
+	routes, err := ratelimit.ParseRoutes(cfg.Routes)
+	if err != nil {
+		return err
+	}
+
+	limiter = &ratelimit.Limiter{Store: store, Default: def, Routes: routes}
+	return nil
+}
+
+// RateLimit limits requests per API key, or per IP on public routes. Use
+// after HeaderAuth so the key is known. Store errors let requests through.
+func RateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if limiter == nil {
+			return next(c)
+		}
+
+		key := "ip:" + c.RealIP()
+		var keyLimit ratelimit.Limit
+		if p := GetPrincipal(c); p != nil {
+			key = "key:bootstrap"
+			if p.Key != nil {
+				key = "key:" + p.Key.ID.String()
+				keyLimit = ratelimit.Limit{PerMinute: p.Key.RatePerMinute, Burst: p.Key.RateBurst}
+			}
+		}
+
+		res, err := limiter.Allow(c.Request().Context(), key, c.Request().Method+" "+c.Path(), keyLimit)
+		return respond(c, next, key, res, err)
+	}
+}
+
+// RateLimitIP limits requests per IP before HeaderAuth, so requests with
+// bad or missing keys cannot flood the API key lookups.
+func RateLimitIP(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if limiter == nil {
+			return next(c)
+		}
+
+		key := "auth-ip:" + c.RealIP()
+		res, err := limiter.Store.Take(c.Request().Context(), key, ipLimit)
+		return respond(c, next, key, res, err)
+	}
+}
+
+// RateLimitCallback limits QPay callbacks per callback ID. QPay calls from
+// a few addresses, so callbacks are never limited per IP and the ID keeps
+// one invoice from draining the others.
+func RateLimitCallback(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if limiter == nil {
+			return next(c)
+		}
+
+		key := "callback:" + c.Param("callbackID")
+		res, err := limiter.Allow(c.Request().Context(), key, c.Request().Method+" "+c.Path(), ratelimit.Limit{})
+		return respond(c, next, key, res, err)
+	}
+}
+
+// respond sets the rate limit headers of res and rejects the request when
+// it is not allowed.
+func respond(c echo.Context, next echo.HandlerFunc, key string, res ratelimit.Result, err error) error {
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not check rate limit of %v", key)
+		return next(c)
+	}
+
+	h := c.Response().Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(res.Reset.Seconds())))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(int(res.RetryAfter.Seconds())))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+	}
+	return next(c)
+}
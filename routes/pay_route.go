@@ -0,0 +1,16 @@
+// routes/pay_route.go
+package routes
+
+import (
+	c "qpay/controllers"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PayRoute serves the public hosted payment page, keyed by the QPay
+// invoice id so links can not be guessed from invoice numbers.
+func PayRoute(e *echo.Echo) {
+	e.GET("/pay/:invoiceID", c.PayPage, m.RateLimit)
+	e.GET("/pay/:invoiceID/status", c.PayStatus, m.RateLimit)
+}
@@ -0,0 +1,18 @@
+// routes/payment_route.go
+package routes
+
+import (
+	c "qpay/controllers"
+	"qpay/models"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+func PaymentRoute(e *echo.Echo) {
+	read := m.RequireScope(models.ScopeInvoicesRead)
+	create := m.RequireScope(models.ScopeInvoicesCreate)
+
+	e.GET("/api/v1/payments/:paymentID/ebarimt", c.GetEbarimt, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.POST("/api/v1/payments/:paymentID/ebarimt", c.CreateEbarimt, m.RateLimitIP, m.HeaderAuth, m.RateLimit, create)
+}
@@ -0,0 +1,17 @@
+// routes/reconciliation_route.go
+package routes
+
+import (
+	c "qpay/controllers"
+	"qpay/models"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+func ReconciliationRoute(e *echo.Echo) {
+	read := m.RequireScope(models.ScopeInvoicesRead)
+
+	e.GET("/api/v1/reconciliation", c.GetReconciliation, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.POST("/api/v1/reconciliation", c.FixReconciliation, m.RateLimitIP, m.HeaderAuth, m.RateLimit, m.AdminOnly)
+}
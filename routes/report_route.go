@@ -0,0 +1,16 @@
+// routes/report_route.go
+package routes
+
+import (
+	c "qpay/controllers"
+	"qpay/models"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+func ReportRoute(e *echo.Echo) {
+	read := m.RequireScope(models.ScopeInvoicesRead)
+
+	e.GET("/api/v1/reports/settlement", c.GetSettlementReport, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	c "qpay/controllers"
+	"qpay/models"
+	m "qpay/routes/middlewares"
+
+	"github.com/labstack/echo/v4"
+)
+
+func WebhookRoute(e *echo.Echo) {
+	read := m.RequireScope(models.ScopeInvoicesRead)
+	create := m.RequireScope(models.ScopeInvoicesCreate)
+
+	e.GET("/api/v1/webhooks", c.ListWebhooks, m.RateLimitIP, m.HeaderAuth, m.RateLimit, read)
+	e.POST("/api/v1/webhooks/:id/redeliver", c.RedeliverWebhook, m.RateLimitIP, m.HeaderAuth, m.RateLimit, create)
+}